@@ -0,0 +1,177 @@
+package attachment
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/etcd-io/bbolt"
+)
+
+// entriesBucket is the bbolt bucket that holds key to Entry entries, encoded
+// as JSON.
+var entriesBucket = []byte("entries")
+
+// failuresBucket is the bbolt bucket that holds key to Failure entries, encoded
+// as JSON.
+var failuresBucket = []byte("failures")
+
+// OpenDB opens the bbolt database at path, creating it if necessary, and uses
+// it to persist m's entries.
+//
+// Entries already in the database are loaded into m, discarding any whose files
+// no longer exist. Each subsequent entry is committed to the database in its
+// own transaction as soon as its file is written, so no progress is lost if
+// the process exits unexpectedly.
+//
+// Entries already in m (e.g., loaded by LoadFromJSON) are migrated into the
+// database.
+func (m *Mapper) OpenDB(path string) error {
+	if m.db != nil {
+		return errors.New("database is already open")
+	}
+
+	db, err := bbolt.Open(path, 0644, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return fmt.Errorf("could not open database %s: %w", path, err)
+	}
+
+	var stale [][]byte
+	err = db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(entriesBucket)
+		if err != nil {
+			return err
+		}
+
+		// Load existing entries.
+		err = b.ForEach(func(k, v []byte) error {
+			key, e := string(k), decodeDBEntry(v)
+			if _, err := os.Stat(e.Path); err != nil && !m.KeepMissing {
+				if os.IsNotExist(err) {
+					log.Printf("Entry for %s does not exist; discarding: %s", key, e.Path)
+					stale = append(stale, k)
+					return nil
+				}
+				return fmt.Errorf("failed to stat key %s, path %s: %w", key, e.Path, err)
+			}
+			m.attachments.Store(key, e)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range stale {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		// Migrate entries that are only in memory.
+		if err := migrateToBucket(b, &m.attachments); err != nil {
+			return err
+		}
+
+		// Load and migrate failures.
+		fb, err := tx.CreateBucketIfNotExists(failuresBucket)
+		if err != nil {
+			return err
+		}
+		err = fb.ForEach(func(k, v []byte) error {
+			var f Failure
+			if err := json.Unmarshal(v, &f); err != nil {
+				return fmt.Errorf("could not decode failure for key %s: %w", k, err)
+			}
+			m.failures.Store(string(k), &f)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return migrateToBucket(fb, &m.failures)
+	})
+	if err != nil {
+		db.Close()
+		return fmt.Errorf("could not load database %s: %w", path, err)
+	}
+
+	m.db = db
+	return nil
+}
+
+// migrateToBucket stores each value in vs that is not already in b, encoded as
+// JSON.
+func migrateToBucket(b *bbolt.Bucket, vs *sync.Map) (err error) {
+	vs.Range(func(k, v interface{}) bool {
+		key := []byte(k.(string))
+		if b.Get(key) == nil {
+			var data []byte
+			if data, err = json.Marshal(v); err == nil {
+				err = b.Put(key, data)
+			}
+		}
+		return err == nil
+	})
+	return
+}
+
+// Close closes m's database, if one is open.
+func (m *Mapper) Close() error {
+	if m.db == nil {
+		return nil
+	}
+	err := m.db.Close()
+	m.db = nil
+	return err
+}
+
+// persist commits the entry for key to m's database, if one is open.
+func (m *Mapper) persist(key string, e *Entry) error {
+	if m.db == nil {
+		return nil
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return m.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(entriesBucket).Put([]byte(key), data)
+	})
+}
+
+// unpersist removes the entry for key from m's database, if one is open.
+func (m *Mapper) unpersist(key string) error {
+	return m.deleteFromBucket(entriesBucket, key)
+}
+
+// persistFailure commits the failure for key to m's database, if one is open.
+func (m *Mapper) persistFailure(key string, f *Failure) error {
+	if m.db == nil {
+		return nil
+	}
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	return m.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(failuresBucket).Put([]byte(key), data)
+	})
+}
+
+// unpersistFailure removes the failure for key from m's database, if one is
+// open.
+func (m *Mapper) unpersistFailure(key string) error {
+	return m.deleteFromBucket(failuresBucket, key)
+}
+
+func (m *Mapper) deleteFromBucket(bucket []byte, key string) error {
+	if m.db == nil {
+		return nil
+	}
+	return m.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucket).Delete([]byte(key))
+	})
+}
@@ -0,0 +1,74 @@
+package attachment
+
+import (
+	"fmt"
+	"time"
+)
+
+// Failure records an attachment that could not be downloaded from any of its
+// URLs.
+type Failure struct {
+	// URLs are the URLs that were tried, in order.
+	URLs []string `json:"urls"`
+	// Errors holds the error for each URL tried during the most recent attempt.
+	Errors []*URLError `json:"errors,omitempty"`
+	// Attempts is the number of times that downloading has failed.
+	Attempts int `json:"attempts"`
+	// LastAttempt is the time of the most recent failed attempt.
+	LastAttempt *time.Time `json:"last_attempt,omitempty"`
+
+	// ConversationID and EventID identify the event that the attachment belongs
+	// to.
+	ConversationID string `json:"conversation_id,omitempty"`
+	EventID        string `json:"event_id,omitempty"`
+}
+
+// URLError is the error from downloading a single URL.
+type URLError struct {
+	URL   string `json:"url"`
+	Error string `json:"error"`
+}
+
+// RecordFailure records that downloading key failed. f's Attempts is set to one
+// more than that of any failure already recorded for key, and its LastAttempt
+// is set to the current time.
+func (m *Mapper) RecordFailure(key string, f *Failure) error {
+	f.Attempts = 1
+	if prev := m.GetFailure(key); prev != nil {
+		f.Attempts = prev.Attempts + 1
+	}
+	now := time.Now().UTC()
+	f.LastAttempt = &now
+
+	m.failures.Store(key, f)
+	if err := m.persistFailure(key, f); err != nil {
+		return fmt.Errorf("failed to persist failure for key %s: %w", key, err)
+	}
+	return nil
+}
+
+// GetFailure returns the failure recorded for key, or nil if there is none. The
+// returned failure must not be modified.
+func (m *Mapper) GetFailure(key string) *Failure {
+	if v, ok := m.failures.Load(key); ok {
+		return v.(*Failure)
+	}
+	return nil
+}
+
+// RangeFailures calls fn for each failure recorded in m. If fn returns false,
+// iteration stops.
+func (m *Mapper) RangeFailures(fn func(key string, f *Failure) bool) {
+	m.failures.Range(func(k, v interface{}) bool {
+		return fn(k.(string), v.(*Failure))
+	})
+}
+
+// ClearFailure removes any failure recorded for key.
+func (m *Mapper) ClearFailure(key string) error {
+	if _, ok := m.failures.Load(key); !ok {
+		return nil
+	}
+	m.failures.Delete(key)
+	return m.unpersistFailure(key)
+}
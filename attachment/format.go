@@ -1,6 +1,63 @@
 package attachment
 
+import (
+	"encoding/json"
+	"time"
+)
+
 type outputFormat struct {
-	// Map of source URL to destination file path.
-	Entries map[string]string `json:"entries"`
+	// Map of attachment key to its entry.
+	Entries map[string]*Entry `json:"entries"`
+
+	// Map of attachment key to its most recent download failure.
+	Failures map[string]*Failure `json:"failures,omitempty"`
+}
+
+// Entry is the manifest record for a single attachment.
+type Entry struct {
+	// Path is the destination file path.
+	Path string `json:"path"`
+
+	// SourceURL is the URL that the attachment was successfully downloaded from.
+	SourceURL string `json:"source_url,omitempty"`
+	// MediaType is the attachment's media type.
+	MediaType string `json:"media_type,omitempty"`
+	// Size is the size of the attachment, in bytes.
+	Size int64 `json:"size,omitempty"`
+	// SHA256 is the hex-encoded SHA-256 of the attachment's content.
+	SHA256 string `json:"sha256,omitempty"`
+	// HTTPStatus is the status code of the successful download response.
+	HTTPStatus int `json:"http_status,omitempty"`
+	// DownloadedAt is the time that the download completed.
+	DownloadedAt *time.Time `json:"downloaded_at,omitempty"`
+
+	// ConversationID and EventID identify the event that the attachment was
+	// downloaded for.
+	ConversationID string `json:"conversation_id,omitempty"`
+	EventID        string `json:"event_id,omitempty"`
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+//
+// Older manifests map each key directly to its path. These are loaded as
+// entries with no other metadata.
+func (e *Entry) UnmarshalJSON(data []byte) error {
+	var path string
+	if err := json.Unmarshal(data, &path); err == nil {
+		*e = Entry{Path: path}
+		return nil
+	}
+
+	type entryFields Entry
+	return json.Unmarshal(data, (*entryFields)(e))
+}
+
+// decodeDBEntry decodes an Entry stored in the database. Older databases store
+// the path as the raw value.
+func decodeDBEntry(v []byte) *Entry {
+	var e Entry
+	if err := json.Unmarshal(v, &e); err != nil {
+		return &Entry{Path: string(v)}
+	}
+	return &e
 }
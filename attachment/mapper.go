@@ -8,10 +8,10 @@ import (
 	"log"
 	"os"
 	"path/filepath"
-	"strings"
 	"sync"
 
 	"github.com/danjacques/hangouts-migrate/util"
+	"github.com/etcd-io/bbolt"
 )
 
 var Exists = errors.New("Already exists")
@@ -21,7 +21,15 @@ type Mapper struct {
 	BasePath  string
 	Overwrite bool
 
+	// KeepMissing, if true, retains loaded entries whose files do not exist,
+	// rather than discarding them.
+	KeepMissing bool
+
 	attachments sync.Map
+	failures    sync.Map
+
+	// db, if not nil, persists entries. See OpenDB.
+	db *bbolt.DB
 }
 
 func (m *Mapper) LoadFromJSON(r io.Reader) error {
@@ -31,25 +39,47 @@ func (m *Mapper) LoadFromJSON(r io.Reader) error {
 		return err
 	}
 	for k, v := range of.Entries {
-		if _, err := os.Stat(v); err != nil {
+		if v == nil {
+			continue
+		}
+		if _, err := os.Stat(v.Path); err != nil && !m.KeepMissing {
 			if os.IsNotExist(err) {
-				log.Printf("Entry for %s does not exist; discarding: %s", k, v)
+				log.Printf("Entry for %s does not exist; discarding: %s", k, v.Path)
 				continue
 			} else {
-				return fmt.Errorf("failed to stat key %s, path %s: %w", k, v, err)
+				return fmt.Errorf("failed to stat key %s, path %s: %w", k, v.Path, err)
 			}
 		}
 		m.attachments.Store(k, v)
+		if err := m.persist(k, v); err != nil {
+			return fmt.Errorf("failed to persist key %s: %w", k, err)
+		}
+	}
+	for k, v := range of.Failures {
+		if v == nil {
+			continue
+		}
+		m.failures.Store(k, v)
+		if err := m.persistFailure(k, v); err != nil {
+			return fmt.Errorf("failed to persist failure for key %s: %w", k, err)
+		}
 	}
 	return nil
 }
 
 func (m *Mapper) SaveToJSON(w io.Writer) error {
 	of := outputFormat{
-		Entries: make(map[string]string),
+		Entries: make(map[string]*Entry),
 	}
 	m.attachments.Range(func(k, v interface{}) bool {
-		of.Entries[k.(string)] = v.(string)
+		of.Entries[k.(string)] = v.(*Entry)
+		return true
+	})
+	m.RangeFailures(func(key string, f *Failure) bool {
+		if of.Failures == nil {
+			of.Failures = make(map[string]*Failure)
+		}
+		of.Failures[key] = f
 		return true
 	})
 	enc := json.NewEncoder(w)
@@ -57,24 +87,55 @@ func (m *Mapper) SaveToJSON(w io.Writer) error {
 	return enc.Encode(&of)
 }
 
+// Range calls fn for each entry in m. If fn returns false, iteration stops.
+func (m *Mapper) Range(fn func(key string, e *Entry) bool) {
+	m.attachments.Range(func(k, v interface{}) bool {
+		return fn(k.(string), v.(*Entry))
+	})
+}
+
+// Delete removes the entry for key from m, and from its database if one is
+// open. The entry's file is not removed.
+func (m *Mapper) Delete(key string) error {
+	m.attachments.Delete(key)
+	return m.unpersist(key)
+}
+
 func (m *Mapper) Mapped(key string) bool {
 	_, ok := m.attachments.Load(key)
 	return ok
 }
 
 func (m *Mapper) OpenWriter(key string, mediaType string) (*Writer, error) {
+	return m.openWriter(key, mediaType, false)
+}
+
+// ResumeWriter is like OpenWriter, but appends to the partial download for key
+// described by pi (see Partial). pi is retained, so the Writer remains
+// resumable.
+func (m *Mapper) ResumeWriter(key string, pi *PartialInfo) (*Writer, error) {
+	w, err := m.openWriter(key, pi.MediaType, true)
+	if err != nil {
+		return nil, err
+	}
+	w.SetPartialInfo(pi)
+	return w, nil
+}
+
+func (m *Mapper) openWriter(key string, mediaType string, resume bool) (*Writer, error) {
 	if m.BasePath == "" {
 		return nil, errors.New("cannot write files, no base path set")
 	}
 
 	name := util.HashForKey(key)
-	if ext := extensionForMediaType(mediaType); ext != "" {
+	if ext := ExtensionForMediaType(mediaType); ext != "" {
 		name = fmt.Sprintf("%s.%s", name, ext)
 	}
 
 	// Always store the path, even if we don't end up writing it.
 	path := filepath.Join(m.BasePath, name)
-	if _, ok := m.attachments.LoadOrStore(key, path); ok {
+	placeholder := &Entry{Path: path, MediaType: mediaType}
+	if _, ok := m.attachments.LoadOrStore(key, placeholder); ok {
 		// An entry already exists.
 		return nil, Exists
 	}
@@ -88,16 +149,48 @@ func (m *Mapper) OpenWriter(key string, mediaType string) (*Writer, error) {
 		}
 	}
 
-	return makeWriter(path)
+	tempPath := m.tempPathForKey(key)
+	if !resume {
+		removePartial(tempPath)
+	}
+	w, err := makeWriter(path, tempPath, resume)
+	if err != nil {
+		m.attachments.Delete(key)
+		return nil, err
+	}
+	w.entry.MediaType = mediaType
+	w.commit = func(e *Entry) error {
+		m.attachments.Store(key, e)
+		if err := m.persist(key, e); err != nil {
+			return err
+		}
+		return m.ClearFailure(key)
+	}
+	w.discard = func() {
+		// Forget the path, so that the key may be written again.
+		if v, ok := m.attachments.Load(key); ok && v == placeholder {
+			m.attachments.Delete(key)
+		}
+	}
+	return w, nil
 }
 
 func (m *Mapper) GetPath(key string) string {
-	if v, ok := m.attachments.Load(key); ok {
-		return v.(string)
+	if e := m.GetEntry(key); e != nil {
+		return e.Path
 	}
 	return ""
 }
 
+// GetEntry returns the entry for key, or nil if there is none. The returned
+// entry must not be modified.
+func (m *Mapper) GetEntry(key string) *Entry {
+	if v, ok := m.attachments.Load(key); ok {
+		return v.(*Entry)
+	}
+	return nil
+}
+
 func (m *Mapper) ScanPathForKey(key string) (string, error) {
 	if path := m.GetPath(key); path != "" {
 		// Already in m.
@@ -115,28 +208,13 @@ func (m *Mapper) ScanPathForKey(key string) (string, error) {
 		return "", fmt.Errorf("failed to glob %s: %w", pathGlob, err)
 	}
 	if len(matches) > 0 {
-		v, _ := m.attachments.LoadOrStore(key, matches[0])
-		return v.(string), nil
-	}
-	return "", NotFound
-}
-
-var autoPrefixes = []string{"image/", "video/"}
-
-func extensionForMediaType(mt string) string {
-	switch mt {
-	case "image/jpeg":
-		return "jpg"
-	case "image/png":
-		return "png"
-	case "image/gif":
-		return "gif"
-	default:
-		for _, ap := range autoPrefixes {
-			if strings.HasPrefix(mt, ap) {
-				return strings.TrimPrefix(mt, ap)
+		v, loaded := m.attachments.LoadOrStore(key, &Entry{Path: matches[0]})
+		if !loaded {
+			if err := m.persist(key, v.(*Entry)); err != nil {
+				return "", fmt.Errorf("failed to persist key %s: %w", key, err)
 			}
 		}
-		return ""
+		return v.(*Entry).Path, nil
 	}
+	return "", NotFound
 }
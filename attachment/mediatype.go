@@ -0,0 +1,227 @@
+package attachment
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// SniffLen is the number of leading content bytes that SniffMediaType
+// considers.
+const SniffLen = 512
+
+// mediaTypeExtensions maps media types to their preferred file extension.
+var mediaTypeExtensions = map[string]string{
+	"image/jpeg":    "jpg",
+	"image/png":     "png",
+	"image/gif":     "gif",
+	"image/webp":    "webp",
+	"image/heic":    "heic",
+	"image/heif":    "heif",
+	"image/bmp":     "bmp",
+	"image/tiff":    "tiff",
+	"image/svg+xml": "svg",
+	"image/x-icon":  "ico",
+
+	"video/mp4":        "mp4",
+	"video/quicktime":  "mov",
+	"video/webm":       "webm",
+	"video/3gpp":       "3gp",
+	"video/3gpp2":      "3g2",
+	"video/mpeg":       "mpg",
+	"video/x-msvideo":  "avi",
+	"video/x-matroska": "mkv",
+	"video/x-ms-wmv":   "wmv",
+	"video/x-flv":      "flv",
+
+	"audio/mpeg": "mp3",
+	"audio/mp4":  "m4a",
+	"audio/aac":  "aac",
+	"audio/ogg":  "ogg",
+	"audio/wav":  "wav",
+	"audio/amr":  "amr",
+
+	"application/pdf": "pdf",
+	"application/zip": "zip",
+	"text/plain":      "txt",
+}
+
+// extensionMediaTypes maps file extensions to media types. It is the inverse of
+// mediaTypeExtensions, plus common alternate extensions.
+var extensionMediaTypes = func() map[string]string {
+	m := map[string]string{
+		"jpeg": "image/jpeg",
+		"jpe":  "image/jpeg",
+		"tif":  "image/tiff",
+		"m4v":  "video/mp4",
+		"qt":   "video/quicktime",
+		"mpeg": "video/mpeg",
+	}
+	for mt, ext := range mediaTypeExtensions {
+		m[ext] = mt
+	}
+	return m
+}()
+
+// Aliases of media types that servers report, mapped to their canonical form.
+var mediaTypeAliases = map[string]string{
+	"image/jpg":           "image/jpeg",
+	"image/pjpeg":         "image/jpeg",
+	"image/x-png":         "image/png",
+	"image/heic-sequence": "image/heic",
+	"image/heif-sequence": "image/heif",
+	"video/x-m4v":         "video/mp4",
+	"audio/x-wav":         "audio/wav",
+	"audio/wave":          "audio/wav",
+	"audio/x-m4a":         "audio/mp4",
+}
+
+// ExtensionForMediaType returns the file extension (without a leading ".")
+// for the media type mt, or an empty string if it is not known.
+func ExtensionForMediaType(mt string) string {
+	return mediaTypeExtensions[canonicalMediaType(mt)]
+}
+
+// MediaTypeForPath returns the media type implied by path's extension, or an
+// empty string if it is not known.
+func MediaTypeForPath(path string) string {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(path), "."))
+	return extensionMediaTypes[ext]
+}
+
+func canonicalMediaType(mt string) string {
+	if parsed, _, err := mime.ParseMediaType(mt); err == nil {
+		mt = parsed
+	}
+	mt = strings.ToLower(mt)
+	if alias, ok := mediaTypeAliases[mt]; ok {
+		return alias
+	}
+	return mt
+}
+
+// mediaTypeFamilies maps media types to the family of types that are
+// distinguished only by their ISO base media file brand. Files are often
+// labelled with a different type of the same family (e.g., a ".heic" file with
+// the "mif1" brand), so these are not told apart reliably.
+var mediaTypeFamilies = map[string]string{
+	"image/heic": "heif",
+	"image/heif": "heif",
+
+	"video/mp4":       "iso-bmff",
+	"video/quicktime": "iso-bmff",
+	"video/3gpp":      "iso-bmff",
+	"video/3gpp2":     "iso-bmff",
+	"audio/mp4":       "iso-bmff",
+}
+
+// sameMediaTypeFamily returns true if a and b are the same media type, or are
+// in the same family (see mediaTypeFamilies).
+func sameMediaTypeFamily(a, b string) bool {
+	a, b = canonicalMediaType(a), canonicalMediaType(b)
+	if a == b {
+		return true
+	}
+	family, ok := mediaTypeFamilies[a]
+	return ok && family == mediaTypeFamilies[b]
+}
+
+// heifBrands maps HEIF "ftyp" major brands to their media type.
+var heifBrands = map[string]string{
+	"heic": "image/heic",
+	"heix": "image/heic",
+	"heim": "image/heic",
+	"heis": "image/heic",
+	"hevc": "image/heic",
+	"hevx": "image/heic",
+	"hevm": "image/heic",
+	"hevs": "image/heic",
+	"mif1": "image/heif",
+	"msf1": "image/heif",
+}
+
+// SniffMediaType determines the media type of content from its leading bytes,
+// head. It recognizes common image and video formats, including those that
+// net/http's sniffing does not (HEIC, QuickTime), and falls back on
+// http.DetectContentType otherwise.
+//
+// The returned type has no parameters. If the content is not recognized,
+// "application/octet-stream" or "text/plain" is returned.
+func SniffMediaType(head []byte) string {
+	if len(head) > SniffLen {
+		head = head[:SniffLen]
+	}
+
+	switch {
+	case bytes.HasPrefix(head, []byte{0xFF, 0xD8, 0xFF}):
+		return "image/jpeg"
+	case bytes.HasPrefix(head, []byte("\x89PNG\r\n\x1a\n")):
+		return "image/png"
+	case bytes.HasPrefix(head, []byte("GIF87a")), bytes.HasPrefix(head, []byte("GIF89a")):
+		return "image/gif"
+	case len(head) >= 12 && bytes.HasPrefix(head, []byte("RIFF")) && string(head[8:12]) == "WEBP":
+		return "image/webp"
+	case bytes.HasPrefix(head, []byte{0x1A, 0x45, 0xDF, 0xA3}):
+		// EBML; distinguish WebM from Matroska by its DocType.
+		if bytes.Contains(head, []byte("webm")) {
+			return "video/webm"
+		}
+		return "video/x-matroska"
+	}
+
+	if mt := sniffISOBMFF(head); mt != "" {
+		return mt
+	}
+
+	mt, _, err := mime.ParseMediaType(http.DetectContentType(head))
+	if err != nil {
+		return "application/octet-stream"
+	}
+	return mt
+}
+
+// sniffISOBMFF identifies ISO base media files (MP4, QuickTime, HEIF, 3GPP)
+// from their leading box.
+func sniffISOBMFF(head []byte) string {
+	if len(head) < 12 {
+		return ""
+	}
+
+	switch string(head[4:8]) {
+	case "ftyp":
+	case "moov", "mdat", "wide", "free", "skip", "pnot":
+		// Older QuickTime files have no "ftyp" box.
+		return "video/quicktime"
+	default:
+		return ""
+	}
+
+	brand := string(head[8:12])
+	switch {
+	case brand == "qt  ":
+		return "video/quicktime"
+	case strings.HasPrefix(brand, "3gp"):
+		return "video/3gpp"
+	case strings.HasPrefix(brand, "3g2"):
+		return "video/3gpp2"
+	case brand == "M4A ":
+		return "audio/mp4"
+	}
+	if mt, ok := heifBrands[brand]; ok {
+		return mt
+	}
+	return "video/mp4"
+}
+
+// IsDefinitiveMediaType returns true if mt identifies specific content, rather
+// than being a generic fallback.
+func IsDefinitiveMediaType(mt string) bool {
+	switch canonicalMediaType(mt) {
+	case "", "application/octet-stream", "text/plain", "binary/octet-stream":
+		return false
+	default:
+		return true
+	}
+}
@@ -0,0 +1,108 @@
+package attachment
+
+import (
+	"testing"
+)
+
+func TestSniffMediaType(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name string
+		head string
+		want string
+	}{
+		{"jpeg", "\xff\xd8\xff\xe0\x00\x10JFIF", "image/jpeg"},
+		{"png", "\x89PNG\r\n\x1a\n\x00\x00", "image/png"},
+		{"gif87a", "GIF87a...", "image/gif"},
+		{"gif89a", "GIF89a...", "image/gif"},
+		{"webp", "RIFF\x00\x00\x00\x00WEBPVP8 ", "image/webp"},
+		{"webm", "\x1a\x45\xdf\xa3\x9f\x42\x86\x81\x01\x42\x82\x84webm", "video/webm"},
+		{"matroska", "\x1a\x45\xdf\xa3\x9f\x42\x86\x81\x01\x42\x82\x88matroska", "video/x-matroska"},
+		{"heic", "\x00\x00\x00\x18ftypheic\x00\x00\x00\x00", "image/heic"},
+		{"heic hevc", "\x00\x00\x00\x18ftyphevc\x00\x00\x00\x00", "image/heic"},
+		{"heif mif1", "\x00\x00\x00\x18ftypmif1\x00\x00\x00\x00", "image/heif"},
+		{"mp4", "\x00\x00\x00\x18ftypisom\x00\x00\x02\x00", "video/mp4"},
+		{"mp4 mp42", "\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00", "video/mp4"},
+		{"quicktime", "\x00\x00\x00\x14ftypqt  \x00\x00\x00\x00", "video/quicktime"},
+		{"quicktime without ftyp", "\x00\x00\x00\x08wide\x00\x00\x00\x00", "video/quicktime"},
+		{"3gpp", "\x00\x00\x00\x18ftyp3gp4\x00\x00\x00\x00", "video/3gpp"},
+		{"3gpp2", "\x00\x00\x00\x18ftyp3g2a\x00\x00\x00\x00", "video/3gpp2"},
+		{"m4a", "\x00\x00\x00\x18ftypM4A \x00\x00\x00\x00", "audio/mp4"},
+		{"pdf", "%PDF-1.4\n", "application/pdf"},
+		{"html", "<!DOCTYPE html><html>", "text/html"},
+		{"text", "just some text", "text/plain"},
+		{"binary", "\x00\x01\x02\x03\x04\x05", "application/octet-stream"},
+		{"empty", "", "text/plain"},
+		{"short ftyp", "\x00\x00\x00\x18ftyp", "application/octet-stream"},
+	} {
+		if got := SniffMediaType([]byte(tc.head)); got != tc.want {
+			t.Errorf("%s: SniffMediaType(%q) = %q, want %q", tc.name, tc.head, got, tc.want)
+		}
+	}
+}
+
+func TestExtensionForMediaType(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		mt   string
+		want string
+	}{
+		{"image/jpeg", "jpg"},
+		{"image/JPEG", "jpg"},
+		{"image/jpg", "jpg"},
+		{"image/jpeg; charset=binary", "jpg"},
+		{"image/heic-sequence", "heic"},
+		{"video/quicktime", "mov"},
+		{"video/x-m4v", "mp4"},
+		{"application/x-unknown", ""},
+		{"", ""},
+	} {
+		if got := ExtensionForMediaType(tc.mt); got != tc.want {
+			t.Errorf("ExtensionForMediaType(%q) = %q, want %q", tc.mt, got, tc.want)
+		}
+	}
+}
+
+func TestMediaTypeForPath(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		path string
+		want string
+	}{
+		{"a/b.jpg", "image/jpeg"},
+		{"b.JPEG", "image/jpeg"},
+		{"b.heic", "image/heic"},
+		{"b.mov", "video/quicktime"},
+		{"b.m4v", "video/mp4"},
+		{"b.txt", "text/plain"},
+		{"b", ""},
+		{"b.unknown", ""},
+	} {
+		if got := MediaTypeForPath(tc.path); got != tc.want {
+			t.Errorf("MediaTypeForPath(%q) = %q, want %q", tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestIsDefinitiveMediaType(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		mt   string
+		want bool
+	}{
+		{"image/jpeg", true},
+		{"video/mp4", true},
+		{"", false},
+		{"application/octet-stream", false},
+		{"binary/octet-stream", false},
+		{"text/plain; charset=utf-8", false},
+	} {
+		if got := IsDefinitiveMediaType(tc.mt); got != tc.want {
+			t.Errorf("IsDefinitiveMediaType(%q) = %v, want %v", tc.mt, got, tc.want)
+		}
+	}
+}
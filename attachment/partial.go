@@ -0,0 +1,110 @@
+package attachment
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/danjacques/hangouts-migrate/util"
+)
+
+// PartialInfo describes a partially-downloaded attachment, so that its download
+// can be resumed.
+type PartialInfo struct {
+	// SourceURL is the URL that the content was downloaded from.
+	SourceURL string `json:"source_url"`
+	// MediaType is the media type of the complete attachment.
+	MediaType string `json:"media_type,omitempty"`
+
+	// ETag and LastModified are the validators returned by the server. At least
+	// one must be set for a download to be resumed.
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	// ContentLength is the size of the complete attachment, or zero if it is
+	// not known.
+	ContentLength int64 `json:"content_length,omitempty"`
+}
+
+// partialInfoSuffix is appended to a temporary file's path to name the file
+// holding its PartialInfo.
+const partialInfoSuffix = ".partial.json"
+
+// tempPathForKey returns the path of the temporary file for key. It is stable,
+// so that a partial download can be found again.
+func (m *Mapper) tempPathForKey(key string) string {
+	return filepath.Join(m.BasePath, "tmp-"+util.HashForKey(key))
+}
+
+// Partial returns the PartialInfo and size of the resumable partial download
+// for key. If there is none, Partial returns nil.
+func (m *Mapper) Partial(key string) (*PartialInfo, int64) {
+	if m.BasePath == "" || m.Overwrite {
+		return nil, 0
+	}
+
+	path := m.tempPathForKey(key)
+	pi, err := readPartialInfo(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("WARNING: Could not read partial download info for %s: %s", key, err)
+		}
+		return nil, 0
+	}
+
+	st, err := os.Stat(path)
+	if err != nil || st.Size() == 0 {
+		return nil, 0
+	}
+	return pi, st.Size()
+}
+
+// readPartialInfo reads the PartialInfo for the temporary file at tempPath.
+func readPartialInfo(tempPath string) (*PartialInfo, error) {
+	data, err := ioutil.ReadFile(tempPath + partialInfoSuffix)
+	if err != nil {
+		return nil, err
+	}
+	var pi PartialInfo
+	if err := json.Unmarshal(data, &pi); err != nil {
+		return nil, fmt.Errorf("could not decode %s: %w", tempPath+partialInfoSuffix, err)
+	}
+	return &pi, nil
+}
+
+// isResumable returns true if the temporary file at tempPath is a partial
+// download that can be resumed.
+func isResumable(tempPath string) bool {
+	pi, err := readPartialInfo(tempPath)
+	if err != nil || pi.SourceURL == "" || (pi.ETag == "" && pi.LastModified == "") {
+		return false
+	}
+	st, err := os.Stat(tempPath)
+	return err == nil && st.Mode().IsRegular() && st.Size() > 0
+}
+
+// DiscardPartial removes any partial download for key.
+func (m *Mapper) DiscardPartial(key string) error {
+	path := m.tempPathForKey(key)
+	removePartial(path)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func writePartialInfo(tempPath string, pi *PartialInfo) error {
+	data, err := json.Marshal(pi)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(tempPath+partialInfoSuffix, data, 0644)
+}
+
+func removePartial(tempPath string) {
+	if err := os.Remove(tempPath + partialInfoSuffix); err != nil && !os.IsNotExist(err) {
+		log.Printf("WARNING: Failed to remove partial download info %s: %s", tempPath, err)
+	}
+}
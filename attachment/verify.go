@@ -0,0 +1,247 @@
+package attachment
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type ProblemKind string
+
+const (
+	ProblemMissing      ProblemKind = "missing"
+	ProblemEmpty        ProblemKind = "empty"
+	ProblemTruncated    ProblemKind = "truncated"
+	ProblemHashMismatch ProblemKind = "hash-mismatch"
+	ProblemTypeMismatch ProblemKind = "type-mismatch"
+	ProblemHTMLPage     ProblemKind = "html-page"
+	ProblemOrphan       ProblemKind = "orphan"
+	ProblemTempFile     ProblemKind = "temp-file"
+
+	// ProblemResumable is a partial download that can be resumed. It is
+	// reported for information, and is left in place by Fix.
+	ProblemResumable ProblemKind = "resumable"
+)
+
+// Problem is an integrity problem found by Verify.
+type Problem struct {
+	Kind ProblemKind
+	// Key is the attachment key of the entry with the problem. It is empty for
+	// files that are not referenced by any entry.
+	Key    string
+	Path   string
+	Detail string
+}
+
+func (p *Problem) String() string {
+	var sb strings.Builder
+	sb.WriteString(string(p.Kind))
+	if p.Key != "" {
+		fmt.Fprintf(&sb, " key=%q", p.Key)
+	}
+	fmt.Fprintf(&sb, " path=%s", p.Path)
+	if p.Detail != "" {
+		fmt.Fprintf(&sb, ": %s", p.Detail)
+	}
+	return sb.String()
+}
+
+// VerifyOptions controls Verify.
+type VerifyOptions struct {
+	// CheckHash, if true, reads each file in full and compares it against its
+	// recorded SHA-256.
+	CheckHash bool
+
+	// Ignore lists paths in BasePath that are not attachments (e.g., the
+	// manifest itself), and should not be reported as orphans.
+	Ignore []string
+}
+
+// Verify checks each of m's entries against the files in BasePath, returning
+// any problems found.
+//
+// Verify is only meaningful if m retains entries whose files are missing; see
+// KeepMissing.
+func (m *Mapper) Verify(opts *VerifyOptions) ([]*Problem, error) {
+	if opts == nil {
+		opts = &VerifyOptions{}
+	}
+
+	var problems []*Problem
+	referenced := make(map[string]struct{})
+	var rangeErr error
+	m.Range(func(key string, e *Entry) bool {
+		referenced[absPath(e.Path)] = struct{}{}
+
+		p, err := verifyEntry(key, e, opts)
+		if err != nil {
+			rangeErr = fmt.Errorf("could not verify key %s: %w", key, err)
+			return false
+		}
+		if p != nil {
+			problems = append(problems, p)
+		}
+		return true
+	})
+	if rangeErr != nil {
+		return nil, rangeErr
+	}
+
+	if m.BasePath != "" {
+		for _, path := range opts.Ignore {
+			referenced[absPath(path)] = struct{}{}
+		}
+
+		dirProblems, err := verifyDir(m.BasePath, referenced)
+		if err != nil {
+			return nil, err
+		}
+		problems = append(problems, dirProblems...)
+	}
+
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].Path < problems[j].Path })
+	return problems, nil
+}
+
+func verifyEntry(key string, e *Entry, opts *VerifyOptions) (*Problem, error) {
+	problem := func(kind ProblemKind, detail string, args ...interface{}) *Problem {
+		return &Problem{Kind: kind, Key: key, Path: e.Path, Detail: fmt.Sprintf(detail, args...)}
+	}
+
+	st, err := os.Stat(e.Path)
+	switch {
+	case os.IsNotExist(err):
+		return problem(ProblemMissing, ""), nil
+	case err != nil:
+		return nil, err
+	case st.Size() == 0:
+		return problem(ProblemEmpty, ""), nil
+	case e.Size > 0 && st.Size() != e.Size:
+		return problem(ProblemTruncated, "size is %d, expected %d", st.Size(), e.Size), nil
+	}
+
+	fd, err := os.Open(e.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	head := make([]byte, SniffLen)
+	n, err := io.ReadFull(fd, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	head = head[:n]
+
+	sniffed := SniffMediaType(head)
+	if sniffed == "text/html" {
+		return problem(ProblemHTMLPage, "content is HTML"), nil
+	}
+	if expected := MediaTypeForPath(e.Path); expected != "" && !mediaTypesAgree(sniffed, expected) {
+		return problem(ProblemTypeMismatch, "content is %s, extension implies %s", sniffed, expected), nil
+	}
+
+	if opts.CheckHash && e.SHA256 != "" {
+		h := sha256.New()
+		h.Write(head)
+		if _, err := io.Copy(h, fd); err != nil {
+			return nil, err
+		}
+		if sum := hex.EncodeToString(h.Sum(nil)); sum != e.SHA256 {
+			return problem(ProblemHashMismatch, "SHA-256 is %s, expected %s", sum, e.SHA256), nil
+		}
+	}
+
+	return nil, nil
+}
+
+// verifyDir reports files in dir that are leftover temporary files, or are not
+// referenced. Resumable partial downloads are reported as such; their
+// PartialInfo files are not reported.
+func verifyDir(dir string, referenced map[string]struct{}) ([]*Problem, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not list %s: %w", dir, err)
+	}
+
+	var problems []*Problem
+	for _, fi := range infos {
+		if fi.IsDir() {
+			continue
+		}
+
+		path := filepath.Join(dir, fi.Name())
+		switch name := fi.Name(); {
+		case strings.HasPrefix(name, "tmp-") && strings.HasSuffix(name, partialInfoSuffix):
+			if !isResumable(strings.TrimSuffix(path, partialInfoSuffix)) {
+				problems = append(problems, &Problem{Kind: ProblemTempFile, Path: path})
+			}
+		case strings.HasPrefix(name, "tmp-"):
+			kind := ProblemTempFile
+			if isResumable(path) {
+				kind = ProblemResumable
+			}
+			problems = append(problems, &Problem{Kind: kind, Path: path})
+		default:
+			if _, ok := referenced[absPath(path)]; !ok {
+				problems = append(problems, &Problem{Kind: ProblemOrphan, Path: path})
+			}
+		}
+	}
+	return problems, nil
+}
+
+// Fix resolves problems returned by Verify. Orphaned and temporary files are
+// deleted, but resumable partial downloads are kept. Entries with problems are
+// removed, along with their files, so that they will be downloaded again.
+func (m *Mapper) Fix(problems []*Problem) error {
+	for _, p := range problems {
+		if p.Kind == ProblemResumable {
+			continue
+		}
+		if p.Key != "" {
+			if err := m.Delete(p.Key); err != nil {
+				return fmt.Errorf("could not delete key %s: %w", p.Key, err)
+			}
+		}
+		if p.Kind == ProblemMissing {
+			continue
+		}
+		if err := os.Remove(p.Path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("could not remove %s: %w", p.Path, err)
+		}
+	}
+	return nil
+}
+
+// mediaTypesAgree returns true unless sniffed definitively contradicts
+// expected. Sniffing falls back on generic types for content it doesn't
+// recognize, and these are not considered contradictions. Nor are types that
+// differ only by their brand, such as HEIC and HEIF, or MP4 and QuickTime;
+// Fix would otherwise delete valid files.
+func mediaTypesAgree(sniffed, expected string) bool {
+	switch {
+	case sniffed == "text/plain":
+		// Text is only a contradiction for media files.
+		return !strings.HasPrefix(expected, "image/") &&
+			!strings.HasPrefix(expected, "video/") &&
+			!strings.HasPrefix(expected, "audio/")
+	case !IsDefinitiveMediaType(sniffed):
+		return true
+	default:
+		return sameMediaTypeFamily(sniffed, expected)
+	}
+}
+
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return filepath.Clean(path)
+}
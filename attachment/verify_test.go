@@ -0,0 +1,129 @@
+package attachment
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// ftyp returns the leading box of an ISO base media file with major brand
+// brand.
+func ftyp(brand string) []byte {
+	return append([]byte("\x00\x00\x00\x18ftyp"), brand+"\x00\x00\x00\x00mif1heic"...)
+}
+
+func TestMediaTypesAgree(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		sniffed, expected string
+		want              bool
+	}{
+		{"image/jpeg", "image/jpeg", true},
+		{"image/jpeg", "image/jpg", true},
+		{"image/png", "image/jpeg", false},
+		{"video/mp4", "image/jpeg", false},
+
+		// Generic types don't contradict anything.
+		{"application/octet-stream", "image/jpeg", true},
+		{"text/plain", "application/pdf", true},
+		{"text/plain", "image/jpeg", false},
+		{"text/plain", "video/mp4", false},
+
+		// Types that differ only by brand agree.
+		{"image/heif", "image/heic", true},
+		{"image/heic", "image/heif", true},
+		{"image/heif", "image/heic-sequence", true},
+		{"image/heic", "image/heif-sequence", true},
+		{"video/mp4", "video/quicktime", true},
+		{"video/quicktime", "video/mp4", true},
+		{"video/3gpp", "video/mp4", true},
+		{"video/mp4", "audio/mp4", true},
+		{"image/heic", "video/mp4", false},
+		{"image/heif", "image/jpeg", false},
+	} {
+		if got := mediaTypesAgree(tc.sniffed, tc.expected); got != tc.want {
+			t.Errorf("mediaTypesAgree(%q, %q) = %v, want %v", tc.sniffed, tc.expected, got, tc.want)
+		}
+	}
+}
+
+func TestVerifyAndFix(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string][]byte{
+		"photo.jpg":  []byte("\xff\xd8\xff\xe0 jpeg"),
+		"photo.heic": ftyp("mif1"),
+		"video.mov":  ftyp("isom"),
+		"video.mp4":  ftyp("qt  "),
+		"wrong.jpg":  []byte("\x89PNG\r\n\x1a\n png"),
+		"page.jpg":   []byte("<!DOCTYPE html><html><body>Sign in</body></html>"),
+		"empty.jpg":  nil,
+		"orphan.jpg": []byte("\xff\xd8\xff\xe0 orphan"),
+		"tmp-key":    []byte("partial"),
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := Mapper{BasePath: dir, KeepMissing: true}
+	var manifest strings.Builder
+	manifest.WriteString(`{"entries":{`)
+	for i, name := range []string{"photo.jpg", "photo.heic", "video.mov", "video.mp4", "wrong.jpg", "page.jpg", "empty.jpg", "missing.jpg"} {
+		if i > 0 {
+			manifest.WriteString(",")
+		}
+		manifest.WriteString(`"` + name + `":{"path":"` + filepath.Join(dir, name) + `"}`)
+	}
+	manifest.WriteString(`}}`)
+	if err := m.LoadFromJSON(strings.NewReader(manifest.String())); err != nil {
+		t.Fatal(err)
+	}
+
+	problems, err := m.Verify(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, p := range problems {
+		got = append(got, string(p.Kind)+" "+filepath.Base(p.Path))
+	}
+	want := []string{
+		"empty empty.jpg",
+		"missing missing.jpg",
+		"orphan orphan.jpg",
+		"html-page page.jpg",
+		"temp-file tmp-key",
+		"type-mismatch wrong.jpg",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got problems:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	if err := m.Fix(problems); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"photo.jpg", "photo.heic", "video.mov", "video.mp4"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("valid file %s was not kept: %s", name, err)
+		}
+		if !m.Mapped(name) {
+			t.Errorf("entry for valid file %s was not kept", name)
+		}
+	}
+	for _, name := range []string{"wrong.jpg", "page.jpg", "empty.jpg", "orphan.jpg", "tmp-key"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("file %s was not removed", name)
+		}
+	}
+}
@@ -1,36 +1,110 @@
 package attachment
 
 import (
-	"io/ioutil"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
 	"log"
 	"os"
-	"path/filepath"
+	"time"
 )
 
 type Writer struct {
 	destPath string
 
 	tempFile *os.File
+	hash     hash.Hash
+
+	// entry is the manifest entry for this file. Its Size, SHA256, and
+	// DownloadedAt fields are populated on Close.
+	entry Entry
+
+	// partial, if not nil, describes how to resume this download. If it is set
+	// when the Writer is aborted, the temporary file is kept so that it may be
+	// resumed later. See SetPartialInfo.
+	partial *PartialInfo
+
+	// commit, if not nil, is called with the completed entry once the
+	// destination file is in place.
+	commit func(e *Entry) error
+
+	// discard, if not nil, is called when the file is aborted.
+	discard func()
 }
 
-func makeWriter(destPath string) (*Writer, error) {
+// makeWriter creates a Writer that writes to tempPath, and moves it to
+// destPath on Close.
+//
+// If resume is true and tempPath exists, writes are appended to its current
+// content. Otherwise, tempPath is truncated.
+func makeWriter(destPath, tempPath string, resume bool) (*Writer, error) {
 	w := &Writer{
 		destPath: destPath,
+		hash:     sha256.New(),
+		entry: Entry{
+			Path: destPath,
+		},
 	}
 
-	// Create our temporary file.
+	flags := os.O_CREATE | os.O_RDWR
+	if !resume {
+		flags |= os.O_TRUNC
+	}
 	var err error
-	w.tempFile, err = ioutil.TempFile(filepath.Dir(w.destPath), "tmp-"+filepath.Base(w.destPath))
+	w.tempFile, err = os.OpenFile(tempPath, flags, 0644)
 	if err != nil {
 		return nil, err
 	}
+
+	// Account for content that is already present.
+	if w.entry.Size, err = io.Copy(w.hash, w.tempFile); err != nil {
+		w.tempFile.Close()
+		return nil, err
+	}
 	return w, nil
 }
 
 func (w *Writer) Path() string { return w.destPath }
 
+// Entry returns the manifest entry that will be recorded for this file. The
+// caller may annotate it with additional metadata before calling Close.
+func (w *Writer) Entry() *Entry { return &w.entry }
+
+// Offset returns the number of bytes already written, including any resumed
+// content.
+func (w *Writer) Offset() int64 { return w.entry.Size }
+
+// SetPartialInfo marks the file as resumable, described by pi. If the Writer
+// is subsequently aborted, its content is kept so that it may be resumed.
+func (w *Writer) SetPartialInfo(pi *PartialInfo) { w.partial = pi }
+
 func (w *Writer) Write(data []byte) (int, error) {
-	return w.tempFile.Write(data)
+	n, err := w.tempFile.Write(data)
+	w.hash.Write(data[:n])
+	w.entry.Size += int64(n)
+	return n, err
+}
+
+// Abort discards the file without moving it into place.
+//
+// If the Writer is resumable (see SetPartialInfo) and has content, the
+// content is kept and can be resumed by Mapper.ResumeWriter.
+func (w *Writer) Abort() error {
+	if w.discard != nil {
+		w.discard()
+	}
+
+	tempFileName := w.tempFile.Name()
+	err := w.tempFile.Close()
+	if w.partial != nil && w.entry.Size > 0 && err == nil {
+		if err = writePartialInfo(tempFileName, w.partial); err == nil {
+			return nil
+		}
+		log.Printf("WARNING: Could not save partial download %s: %s", tempFileName, err)
+	}
+	removePartial(tempFileName)
+	return os.Remove(tempFileName)
 }
 
 func (w *Writer) Close() error {
@@ -52,8 +126,18 @@ func (w *Writer) Close() error {
 	if err := os.Rename(tempFileName, w.destPath); err != nil {
 		return err
 	}
+	removePartial(tempFileName)
 
 	// Clear our tempFileName, marking that no delete needs to happen in defer.
 	tempFileName = ""
+
+	if w.commit != nil {
+		now := time.Now().UTC()
+		w.entry.SHA256 = hex.EncodeToString(w.hash.Sum(nil))
+		w.entry.DownloadedAt = &now
+
+		e := w.entry
+		return w.commit(&e)
+	}
 	return nil
 }
@@ -0,0 +1,110 @@
+package mattermost
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/danjacques/hangouts-migrate/attachment"
+)
+
+const (
+	// archiveImportName is the name of the bulk import in an import archive.
+	archiveImportName = "import.jsonl"
+	// archiveDataDir is the directory in an import archive that holds
+	// attachments. Attachment paths are relative to it.
+	archiveDataDir = "data"
+)
+
+// addFile records that the import references the local file src as dest.
+func (big *BulkImportGenerator) addFile(dest, src string) {
+	if big.files == nil {
+		big.files = make(map[string]string)
+	}
+	if cur, ok := big.files[dest]; ok && cur != src {
+		log.Printf("WARN: Attachments %q and %q are both imported as %q", cur, src, dest)
+		return
+	}
+	big.files[dest] = src
+}
+
+// BuildArchive is like BuildAll, but writes a Mattermost import archive (a zip
+// file, as accepted by "mmctl import upload") to w. The archive contains the
+// bulk import and a copy of each attachment that it references.
+//
+// Attachment paths in the archive are relative to its data directory, so
+// DestAttachmentDir must be a relative path (or empty) within the data
+// directory.
+func (big *BulkImportGenerator) BuildArchive(forEach ConversationIterator, w io.Writer) error {
+	dir := filepath.Clean(big.DestAttachmentDir)
+	if filepath.IsAbs(dir) || dir == ".." || strings.HasPrefix(dir, ".."+string(filepath.Separator)) {
+		return errors.New("the attachment directory of an import archive must be within its data directory")
+	}
+
+	zw := zip.NewWriter(w)
+	iw, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     archiveImportName,
+		Method:   zip.Deflate,
+		Modified: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	if err := big.BuildAll(forEach, NewWriter(iw)); err != nil {
+		return err
+	}
+
+	dests := make([]string, 0, len(big.files))
+	for dest := range big.files {
+		dests = append(dests, dest)
+	}
+	sort.Strings(dests)
+	for _, dest := range dests {
+		if err := addArchiveFile(zw, dest, big.files[dest]); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// addArchiveFile copies the local file src into zw's data directory as dest.
+func addArchiveFile(zw *zip.Writer, dest, src string) error {
+	fd, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("could not open attachment: %w", err)
+	}
+	defer fd.Close()
+
+	st, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+	fh, err := zip.FileInfoHeader(st)
+	if err != nil {
+		return err
+	}
+	fh.Name = path.Join(archiveDataDir, filepath.ToSlash(dest))
+
+	// Photos and videos are already compressed.
+	fh.Method = zip.Store
+	if mt := attachment.MediaTypeForPath(src); mt == "" || strings.HasPrefix(mt, "text/") {
+		fh.Method = zip.Deflate
+	}
+
+	fw, err := zw.CreateHeader(fh)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(fw, fd); err != nil {
+		return fmt.Errorf("could not copy %q: %w", src, err)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package mattermost
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/danjacques/hangouts-migrate/attachment"
+)
+
+// attachmentBatcher holds a post, and collects the attachments of its event and
+// of the attachment-only events by the same sender that follow it. When the
+// post is flushed, its attachments are packed into it and, if there are more
+// than MaxAttachmentsPerPost, into additional posts.
+type attachmentBatcher struct {
+	t *threader
+	// replies, if true, adds the additional posts as replies to the held post,
+	// if it has text.
+	replies bool
+
+	post  *Post
+	ts    time.Time
+	items []batchedAttachment
+}
+
+type batchedAttachment struct {
+	*Attachment
+	ts time.Time
+}
+
+// start holds p, which was posted at ts, with attachments. Any attachments that
+// p already has are collected first.
+func (b *attachmentBatcher) start(p *Post, ts time.Time, attachments []*Attachment) {
+	b.post, b.ts = p, ts
+	b.items = nil
+	b.add(p.Attachments, ts)
+	b.add(attachments, ts)
+	p.Attachments = nil
+}
+
+// extend collects attachments, posted at ts by username, if the held post is
+// by the same user. It returns false if the attachments were not collected.
+func (b *attachmentBatcher) extend(username string, attachments []*Attachment, ts time.Time) bool {
+	if b.post == nil || b.post.User != username {
+		return false
+	}
+	b.add(attachments, ts)
+	return true
+}
+
+func (b *attachmentBatcher) add(attachments []*Attachment, ts time.Time) {
+	for _, a := range attachments {
+		b.items = append(b.items, batchedAttachment{a, ts})
+	}
+}
+
+// flush adds the held post and its attachments, if there is a held post.
+func (b *attachmentBatcher) flush() error {
+	p, items := b.post, b.items
+	if p == nil {
+		return nil
+	}
+	b.post, b.items = nil, nil
+
+	hasText := p.Message != ""
+	n := len(items)
+	first := n
+	if first > MaxAttachmentsPerPost {
+		first = MaxAttachmentsPerPost
+		if !hasText {
+			p.Message = batchSummary(items, 0, first)
+		}
+	}
+	p.Attachments = attachmentsForBatch(items[:first])
+
+	var batches []*Post
+	for i := first; i < n; i += MaxAttachmentsPerPost {
+		j := i + MaxAttachmentsPerPost
+		if j > n {
+			j = n
+		}
+		batches = append(batches, &Post{
+			Team:        p.Team,
+			Channel:     p.Channel,
+			User:        p.User,
+			Message:     batchSummary(items, i, j),
+			CreateAt:    timeToMillisFromEpoch(items[i].ts),
+			Attachments: attachmentsForBatch(items[i:j]),
+		})
+	}
+
+	if b.replies && hasText {
+		return b.t.add(p, b.ts, batches...)
+	}
+	if err := b.t.add(p, b.ts); err != nil {
+		return err
+	}
+	for i, bp := range batches {
+		if err := b.t.add(bp, items[first+i*MaxAttachmentsPerPost].ts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func attachmentsForBatch(items []batchedAttachment) []*Attachment {
+	if len(items) == 0 {
+		return nil
+	}
+	attachments := make([]*Attachment, len(items))
+	for i, item := range items {
+		attachments[i] = item.Attachment
+	}
+	return attachments
+}
+
+// batchSummary describes the batch of items from i to j, e.g.
+// "(photo 6–10 of 50)".
+func batchSummary(items []batchedAttachment, i, j int) string {
+	kind := "photo"
+	for _, item := range items {
+		if !strings.HasPrefix(attachment.MediaTypeForPath(item.Path), "image/") {
+			kind = "attachment"
+			break
+		}
+	}
+
+	if j-i == 1 {
+		return fmt.Sprintf("_(%s %d of %d)_", kind, i+1, len(items))
+	}
+	return fmt.Sprintf("_(%s %d–%d of %d)_", kind, i+1, j, len(items))
+}
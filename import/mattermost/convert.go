@@ -1,10 +1,10 @@
 package mattermost
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"path/filepath"
-	"sort"
 	"strings"
 	"time"
 
@@ -23,54 +23,229 @@ type BulkImportGenerator struct {
 	DestAttachmentDir            string
 	ReactionInjector             *ReactionInjector
 	RequireAllParticipantsMapped bool
+
+	// DirectChannels, if true, imports one-to-one conversations as Mattermost
+	// direct messages, and small group conversations as group messages, instead
+	// of as private channels.
+	DirectChannels bool
+
+	// SystemPosts, if true, imports conversation renames and membership changes
+	// as posts describing them.
+	SystemPosts bool
+	// SystemPostUser, if not empty, is the username (from the user map) that
+	// authors system posts in channels. Otherwise, each is authored by the
+	// user who made the change.
+	SystemPostUser string
+	// ChannelNamesFromRenames, if true, sets each channel's display name from
+	// the conversation's final rename, and its header from the previous name.
+	ChannelNamesFromRenames bool
+	// CallPosts, if true, imports the end of each voice or video call as a post
+	// describing its length and participants. These are authored like system
+	// posts.
+	CallPosts bool
+
+	// ThreadGap, if positive, groups each channel's posts into bursts separated
+	// by at least this much idle time. Each burst is imported as a thread,
+	// whose first post is the root and the rest are its replies.
+	ThreadGap time.Duration
+
+	// MaxMessageLength is the maximum length of a post's message, in runes. If
+	// zero, DefaultMaxMessageLength is used.
+	MaxMessageLength int
+	// LongMessages is how messages longer than MaxMessageLength are imported.
+	// If empty, they are split.
+	LongMessages LongMessageMode
+	// OverflowDir is the local directory to which the full text of long
+	// messages is written when LongMessages is LongMessageAttach. Its files
+	// must be copied to DestAttachmentDir.
+	OverflowDir string
+
+	// AttachmentReplies, if true, imports attachments that don't fit in a post
+	// (see MaxAttachmentsPerPost) as replies to it, rather than as the posts
+	// that follow it.
+	AttachmentReplies bool
+
+	systemPostUser *UserID
+	createAts      map[string]*createAtAllocator
+	files          map[string]string
 }
 
-// BuildBulkImport creates a BulkImport object from a parsed root, r.
+// ConversationIterator invokes fn for each conversation to import.
+//
+// A ConversationIterator may be called several times, and must visit the same
+// conversations in the same order each time.
+type ConversationIterator func(fn func(c parse.EventSource) error) error
+
+// BuildBulkImport creates a BulkImport object from a conversation, c.
+//
+// The conversation is imported into the channel named by ChannelName. c's
+// events are visited more than once; to import conversations that can only be
+// visited once, such as a *parse.StreamConversation, use BuildAll.
 func (big *BulkImportGenerator) Build(c *parse.Conversation, w *BulkImportWriter) error {
-	// Get a list of all users in this conversation/map.
-	allUsers, err := big.allUsers(c)
+	var users userSet
+	if err := big.addUsers(&users, c); err != nil {
+		return err
+	}
+
+	plan := big.planConversation(c, big.ChannelName, big.ChannelDisplayName, nil)
+	forEach := func(fn func(c parse.EventSource) error) error { return fn(c) }
+	return big.build(w, users.users, []*conversationPlan{plan}, forEach)
+}
+
+// BuildAll creates a single BulkImport object containing every conversation
+// visited by forEach.
+//
+// Each conversation is imported into its own channel, whose name is derived
+// from the conversation's name. Users are deduplicated across conversations.
+//
+// If ChannelName is set, forEach must visit a single conversation, which is
+// imported into that channel.
+func (big *BulkImportGenerator) BuildAll(forEach ConversationIterator, w *BulkImportWriter) error {
+	var users userSet
+	var plans []*conversationPlan
+	usedNames := make(map[string]struct{})
+
+	// Plan each conversation. This does not visit any events.
+	err := forEach(func(c parse.EventSource) error {
+		if c.Info() == nil {
+			log.Printf("WARN: Skipping conversation with no metadata.")
+			return nil
+		}
+		if big.ChannelName != "" && len(plans) > 0 {
+			return errors.New("cannot import more than one conversation into a named channel")
+		}
+		if err := big.addUsers(&users, c); err != nil {
+			return err
+		}
+		plans = append(plans, big.planConversation(c, big.ChannelName, big.ChannelDisplayName, usedNames))
+		return nil
+	})
 	if err != nil {
 		return err
 	}
 
+	return big.build(w, users.users, plans, forEach)
+}
+
+// build writes a bulk import of the planned conversations to w.
+//
+// Mattermost requires entries to be ordered by type, so forEach is used to
+// visit conversations once to order their events, once for channel posts, and
+// once for direct posts.
+func (big *BulkImportGenerator) build(w *BulkImportWriter, users []*UserID, plans []*conversationPlan,
+	forEach func(fn func(c parse.EventSource) error) error) error {
+
+	if err := big.resolveSystemPostUser(); err != nil {
+		return err
+	}
+	if err := big.validateLongMessages(); err != nil {
+		return err
+	}
+	big.createAts, big.files = nil, nil
+
+	plansByID := make(map[string]*conversationPlan, len(plans))
+	channelsByUser := make(map[string][]string)
+	var directChannels [][]string
+	directChannelKeys := make(map[string]struct{})
+	for _, plan := range plans {
+		plansByID[plan.id] = plan
+
+		if plan.direct() {
+			key := strings.Join(plan.directMembers, ",")
+			if _, ok := directChannelKeys[key]; !ok {
+				directChannelKeys[key] = struct{}{}
+				directChannels = append(directChannels, plan.directMembers)
+			}
+			continue
+		}
+		for _, username := range plan.members {
+			channelsByUser[username] = append(channelsByUser[username], plan.channelName)
+		}
+		if u := big.systemPostUser; u != nil && (big.SystemPosts || big.CallPosts) && !containsString(plan.members, u.Username) {
+			channelsByUser[u.Username] = append(channelsByUser[u.Username], plan.channelName)
+		}
+	}
+
+	err := forEach(func(c parse.EventSource) error {
+		plan := plansByID[conversationID(c)]
+		if plan == nil {
+			return nil
+		}
+		var err error
+		plan.order, err = big.orderEvents(c)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if big.ChannelNamesFromRenames {
+		if err := big.applyRenames(plansByID, forEach); err != nil {
+			return err
+		}
+	}
+
 	// Add a version entry.
 	if err := w.Add(CurrentVersion()); err != nil {
 		return err
 	}
 
-	// Add a team entry for each participant.
+	// Add a team entry.
 	if err := big.AddTeamEntries(w); err != nil {
 		return err
 	}
 
-	// Add a team entry for each participant.
-	if err := big.AddChannelEntries(w); err != nil {
-		return err
+	// Add a channel entry for each channel conversation.
+	for _, plan := range plans {
+		if plan.direct() {
+			continue
+		}
+		if err := big.AddChannelEntries(w, plan.channelName, plan.channelDisplayName, plan.channelHeader); err != nil {
+			return err
+		}
 	}
 
 	// Add a User entry for each participant.
-	if err := big.AddUserEntries(w, allUsers); err != nil {
+	if err := big.AddUserEntries(w, users, channelsByUser); err != nil {
 		return err
 	}
 
-	// Add a single post, with everything else a reply.
-	if err := big.AddChatPost(w, c); err != nil {
+	// Add posts for each channel conversation.
+	err = forEach(func(c parse.EventSource) error {
+		plan := plansByID[conversationID(c)]
+		if plan == nil || plan.direct() {
+			return nil
+		}
+		return big.addChatPosts(w, c, plan.order, plan.channelName, nil)
+	})
+	if err != nil {
 		return err
 	}
 
-	return nil
-}
+	if len(directChannels) == 0 {
+		return nil
+	}
 
-func (big *BulkImportGenerator) allUsers(c *parse.Conversation) ([]*UserID, error) {
-	var users []*UserID
-	addedUsernames := make(map[string]struct{})
+	// Add direct channels, and then their posts.
+	for _, members := range directChannels {
+		if err := big.AddDirectChannelEntries(w, members); err != nil {
+			return err
+		}
+	}
+	return forEach(func(c parse.EventSource) error {
+		plan := plansByID[conversationID(c)]
+		if plan == nil || !plan.direct() {
+			return nil
+		}
+		return big.addChatPosts(w, c, plan.order, "", plan.directMembers)
+	})
+}
 
+// addUsers adds all users in the user map, and all of c's participants, to us.
+func (big *BulkImportGenerator) addUsers(us *userSet, c parse.EventSource) error {
 	// Add any users in our user map.
 	for _, u := range big.UserMapper.AllUsers() {
-		if _, ok := addedUsernames[u.Username]; ok {
-			continue
-		}
-		users = append(users, u)
+		us.add(u)
 	}
 
 	for _, pd := range c.ParticipantRegistry().AllParticipants() {
@@ -78,21 +253,20 @@ func (big *BulkImportGenerator) allUsers(c *parse.Conversation) ([]*UserID, erro
 		u := big.UserMapper.UserForParticipantID(&pd.ID)
 		if u == nil {
 			if big.RequireAllParticipantsMapped {
-				return nil, fmt.Errorf("Missing required user map entry for: %s", pd.ID)
+				return fmt.Errorf("Missing required user map entry for: %s", pd.ID)
 			}
 			log.Printf("Skipping missing user map for: %s", pd.ID)
 			continue
 		}
 
-		users = append(users, &UserID{
+		us.add(&UserID{
 			Username: u.Username,
 			Email:    u.Email,
 			Admin:    false,
 		})
-		addedUsernames[u.Username] = struct{}{}
 	}
 
-	return users, nil
+	return nil
 }
 
 func (big *BulkImportGenerator) AddTeamEntries(w *BulkImportWriter) error {
@@ -100,29 +274,38 @@ func (big *BulkImportGenerator) AddTeamEntries(w *BulkImportWriter) error {
 	if displayName == "" {
 		displayName = big.TeamName
 	}
-	w.Add(&Team{
+	return w.Add(&Team{
 		Name:        big.TeamName,
 		DisplayName: displayName,
 		Type:        TeamTypeInviteOnly,
 	})
-	return nil
 }
 
-func (big *BulkImportGenerator) AddChannelEntries(w *BulkImportWriter) error {
-	displayName := big.ChannelDisplayName
+func (big *BulkImportGenerator) AddChannelEntries(w *BulkImportWriter, name, displayName, header string) error {
 	if displayName == "" {
-		displayName = big.ChannelName
+		displayName = name
 	}
-	w.Add(&Channel{
+	return w.Add(&Channel{
 		Team:        big.TeamName,
-		Name:        big.ChannelName,
+		Name:        name,
 		DisplayName: displayName,
 		Type:        ChannelTypePrivate,
+		Header:      header,
 	})
-	return nil
 }
 
-func (big *BulkImportGenerator) AddUserEntries(w *BulkImportWriter, users []*UserID) error {
+// AddDirectChannelEntries adds a direct (or group) message channel between
+// members.
+func (big *BulkImportGenerator) AddDirectChannelEntries(w *BulkImportWriter, members []string) error {
+	return w.Add(&DirectChannel{
+		Members:     members,
+		FavoritedBy: members,
+	})
+}
+
+// AddUserEntries adds an entry for each user. Each user is made a member of the
+// channels listed for their username in channelsByUser.
+func (big *BulkImportGenerator) AddUserEntries(w *BulkImportWriter, users []*UserID, channelsByUser map[string][]string) error {
 	trueBool := true
 	for _, user := range users {
 		userRole, teamRole, channelRole := UserRoleUser, TeamRoleUser, ChannelRoleUser
@@ -130,107 +313,182 @@ func (big *BulkImportGenerator) AddUserEntries(w *BulkImportWriter, users []*Use
 			userRole, teamRole, channelRole = UserRoleAdmin, TeamRoleAdmin, ChannelRoleAdmin
 		}
 
+		var channelMemberships []*UserChannelMembership
+		for _, name := range channelsByUser[user.Username] {
+			channelMemberships = append(channelMemberships, &UserChannelMembership{
+				Name:     name,
+				Roles:    channelRole,
+				Favorite: &trueBool,
+			})
+		}
+
 		// Augment "user" with additional membership properties.
-		w.Add(&User{
+		err := w.Add(&User{
 			Username: user.Username,
 			Email:    user.Email,
 			Role:     userRole,
 			Teams: []*UserTeamMembership{
 				&UserTeamMembership{
-					Name:  big.TeamName,
-					Roles: teamRole,
-					Channels: []*UserChannelMembership{
-						&UserChannelMembership{
-							Name:     big.ChannelName,
-							Roles:    channelRole,
-							Favorite: &trueBool,
-						},
-					},
+					Name:     big.TeamName,
+					Roles:    teamRole,
+					Channels: channelMemberships,
 				},
 			},
 		})
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func (big *BulkImportGenerator) AddChatPost(w *BulkImportWriter, c *parse.Conversation) error {
-	// Collect all events and sort by timestamp.
-	type eventAndTime struct {
-		Event     *parse.Event
-		Timestamp time.Time
+// AddChatPost adds a post for each of c's chat messages to the channel named
+// channelName or, if directMembers is not empty, to the direct channel between
+// directMembers.
+//
+// c's events are visited twice, once to order them and once to add them.
+func (big *BulkImportGenerator) AddChatPost(w *BulkImportWriter, c *parse.Conversation, channelName string, directMembers []string) error {
+	order, err := big.orderEvents(c)
+	if err != nil {
+		return err
 	}
-	events := make([]eventAndTime, 0, c.EventsSize())
-	for i := 0; i < c.EventsSize(); i++ {
-		e, err := c.Event(i)
-		if err != nil {
-			return fmt.Errorf("Could not open event #%d: %w", i, err)
-		}
+	return big.addChatPosts(w, c, order, channelName, directMembers)
+}
 
-		// Only care about chat messages.
-		if e.EventType != parse.EventTypeRegularChatMessage {
-			continue
-		}
+// addChatPosts is AddChatPost, with c's events already ordered.
+func (big *BulkImportGenerator) addChatPosts(w *BulkImportWriter, c parse.EventSource, order eventOrder,
+	channelName string, directMembers []string) error {
 
-		ts, err := e.Time()
-		if err != nil {
-			return fmt.Errorf("Could not get timestamp for event #%d: %w", i, err)
-		}
-		events = append(events, eventAndTime{e, ts})
+	t := threader{
+		big:           big,
+		w:             w,
+		directMembers: directMembers,
+		createAts:     big.createAtAllocator(channelName, directMembers),
 	}
-	sort.Slice(events, func(i, j int) bool {
-		return events[i].Timestamp.Before(events[j].Timestamp)
-	})
+	b := attachmentBatcher{
+		t:       &t,
+		replies: big.AttachmentReplies,
+	}
+	err := big.forEachInOrder(c, order, func(e *parse.Event, ts time.Time) error {
+		if e.EventType != parse.EventTypeRegularChatMessage {
+			// Don't merge attachments into posts from before the change.
+			if err := b.flush(); err != nil {
+				return err
+			}
+			if p := big.systemPost(c, e, ts, channelName, len(directMembers) > 0); p != nil {
+				if err := t.add(p, ts); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
 
-	// Use the first event as the initial Post.
-	var lastTextPost *Post
-	for _, e := range events {
-		u := big.UserMapper.UserForParticipantID(e.Event.SenderID)
+		u := big.UserMapper.UserForParticipantID(e.SenderID)
 		if u == nil {
-			desc, err := e.Event.Description(c.ParticipantRegistry())
+			desc, err := e.Description(c.ParticipantRegistry())
 			if err != nil {
 				desc = fmt.Sprintf("ERROR(%s)", err)
 			}
-			log.Printf("ERROR: Skipping post by unmapped sender %s:\n%s", e.Event.SenderID, desc)
-			continue
+			log.Printf("ERROR: Skipping post by unmapped sender %s:\n%s", e.SenderID, desc)
+			return nil
 		}
 
-		text := messageForEvent(e.Event)
-		attachments := big.attachmentsForEvent(e.Event)
-
-		// If this is an attachment-only event, and it shares a username with the
-		// last text post, then try and augment the last text post with
-		// these attachments.
-		if lastTextPost != nil && text == "" && u.Username == lastTextPost.User {
-			for len(attachments) > 0 && len(lastTextPost.Attachments) <= MaxAttachmentsPerPost {
-				lastTextPost.Attachments = append(lastTextPost.Attachments, attachments[0])
-				attachments = attachments[1:]
-			}
-		}
+		text := messageForEvent(e)
+		attachments := big.attachmentsForEvent(e)
 
 		if text == "" && len(attachments) == 0 {
 			// Empty event.
-			continue
+			return nil
+		}
+
+		// If this is an attachment-only event by the sender of the last post,
+		// add its attachments to that post's.
+		if text == "" && b.extend(u.Username, attachments, ts) {
+			return nil
+		}
+		if err := b.flush(); err != nil {
+			return err
 		}
 
 		p := &Post{
-			Team:        big.TeamName,
-			Channel:     big.ChannelName,
-			User:        u.Username,
-			Message:     text,
-			CreateAt:    timeToMillisFromEpoch(e.Timestamp),
-			Attachments: attachments,
+			Team:     big.TeamName,
+			Channel:  channelName,
+			User:     u.Username,
+			Message:  text,
+			CreateAt: timeToMillisFromEpoch(ts),
 		}
-		if text != "" && big.ReactionInjector != nil {
+		if plain := plainTextForEvent(e); plain != "" && big.ReactionInjector != nil {
+			// Match against the message as written, not as rendered.
 			// Reaction timestaho has to exceed the post timestamp. Add a minute.
-			p.Reactions = big.ReactionInjector.Get(text, e.Timestamp.Add(time.Minute))
+			p.Reactions = big.ReactionInjector.Get(plain, ts.Add(time.Minute))
+		}
+		posts, err := big.fitMessage(p, e)
+		if err != nil {
+			return err
 		}
-		w.Add(p)
 
-		if text != "" {
-			lastTextPost = p
+		// Hold the last part, which carries the attachments, in case later
+		// events add to them.
+		last := len(posts) - 1
+		for _, p := range posts[:last] {
+			if err := t.add(p, ts); err != nil {
+				return err
+			}
 		}
+		b.start(posts[last], ts, attachments)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := b.flush(); err != nil {
+		return err
+	}
+	return t.flush()
+}
+
+// systemPost returns a post describing the system or call event e, or nil if
+// there is nothing to post.
+func (big *BulkImportGenerator) systemPost(c parse.EventSource, e *parse.Event, ts time.Time,
+	channelName string, direct bool) *Post {
+
+	text := big.systemEventText(e, c.ParticipantRegistry())
+	if text == "" {
+		return nil
+	}
+	u := big.systemPostAuthor(e, direct)
+	if u == nil {
+		log.Printf("WARN: Skipping system post with no author: %s", text)
+		return nil
+	}
+
+	return &Post{
+		Team:     big.TeamName,
+		Channel:  channelName,
+		User:     u.Username,
+		Message:  text,
+		CreateAt: timeToMillisFromEpoch(ts),
 	}
-	return nil
+}
+
+// addPost adds p to w. If directMembers is not empty, p is added as a post in
+// the direct channel between those members.
+func (big *BulkImportGenerator) addPost(w *BulkImportWriter, p *Post, directMembers []string) error {
+	if len(directMembers) == 0 {
+		return w.Add(p)
+	}
+
+	return w.Add(&DirectPost{
+		ChannelMembers: directMembers,
+		User:           p.User,
+		Message:        p.Message,
+		CreateAt:       p.CreateAt,
+		FlaggedBy:      p.FlaggedBy,
+		Replies:        p.Replies,
+		Reactions:      p.Reactions,
+		Attachments:    p.Attachments,
+	})
 }
 
 func (big *BulkImportGenerator) attachmentsForEvent(e *parse.Event) []*Attachment {
@@ -240,21 +498,27 @@ func (big *BulkImportGenerator) attachmentsForEvent(e *parse.Event) []*Attachmen
 
 	var attachments []*Attachment
 	for _, a := range e.ChatMessage.MessageContent.Attachment {
-		if a.EmbedItem.PlusPhoto == nil {
+		ei := a.EmbedItem
+		if ei == nil {
 			continue
 		}
 
-		path := big.AttachmentMapper.GetPath(a.EmbedItem.Key())
+		path := big.AttachmentMapper.GetPath(ei.Key())
 		if path == "" {
-			log.Printf("ERROR: Skipping unmapped attachment %q", a.EmbedItem.Key())
+			// Places and things are rendered in the message, and their images are
+			// optional.
+			if ei.PlusPhoto != nil || ei.LocalFile != nil {
+				log.Printf("ERROR: Skipping unmapped attachment %q", ei.Key())
+			}
 			continue
 		}
 
 		// Convert from source path to destination path.
-		path = filepath.Join(big.DestAttachmentDir, filepath.Base(path))
+		dest := filepath.Join(big.DestAttachmentDir, filepath.Base(path))
+		big.addFile(dest, path)
 
 		attachments = append(attachments, &Attachment{
-			Path: path,
+			Path: dest,
 		})
 	}
 	return attachments
@@ -265,14 +529,34 @@ func messageForEvent(e *parse.Event) string {
 		return ""
 	}
 
-	var lines []string
-	for _, seg := range e.ChatMessage.MessageContent.Segment {
-		lines = append(lines, seg.Text)
+	mc := e.ChatMessage.MessageContent
+	text := renderSegments(mc.Segment)
+
+	// Describe shared places and links, unless the message already does.
+	for _, a := range mc.Attachment {
+		if a.EmbedItem == nil {
+			continue
+		}
+		if embed := renderEmbedItem(a.EmbedItem, text); embed != "" {
+			if text != "" {
+				text += "\n"
+			}
+			text += embed
+		}
 	}
-	return strings.Join(lines, "\n")
+	return text
 }
 
 func timeToMillisFromEpoch(t time.Time) int64 {
 	const millisecondsInANanosecond = int64(time.Millisecond / time.Nanosecond)
 	return t.UnixNano() / millisecondsInANanosecond
 }
+
+func containsString(vs []string, v string) bool {
+	for _, cur := range vs {
+		if cur == v {
+			return true
+		}
+	}
+	return false
+}
@@ -34,6 +34,9 @@ type typedContainer struct {
 	Channel *Channel `json:"channel,omitempty"`
 	User    *User    `json:"user,omitempty"`
 	Post    *Post    `json:"post,omitempty"`
+
+	DirectChannel *DirectChannel `json:"direct_channel,omitempty"`
+	DirectPost    *DirectPost    `json:"direct_post,omitempty"`
 }
 
 type Bool string
@@ -164,7 +167,7 @@ type Post struct {
 	CreateAt    int64         `json:"create_at"`
 	FlaggedBy   []string      `json:"flagged_by,omitempty"`
 	Replies     []*Reply      `json:"replies,omitempty"`
-	Reactions   []*Reaction   `json:"reaction,omitempty"`
+	Reactions   []*Reaction   `json:"reactions,omitempty"`
 	Attachments []*Attachment `json:"attachments,omitempty"`
 }
 
@@ -189,8 +192,41 @@ type Reaction struct {
 	CreateAt  int64  `json:"create_at"`
 }
 
+type DirectChannel struct {
+	Members     []string `json:"members"`
+	FavoritedBy []string `json:"favorited_by,omitempty"`
+	Header      string   `json:"header,omitempty"`
+}
+
+func (dc *DirectChannel) addToTypedContainer(tc *typedContainer) {
+	tc.Type = "direct_channel"
+	tc.DirectChannel = dc
+}
+
+type DirectPost struct {
+	ChannelMembers []string `json:"channel_members"`
+	User           string   `json:"user"`
+	Message        string   `json:"message"`
+
+	// Post timestamp, in milliseconds from epoch.
+	CreateAt    int64         `json:"create_at"`
+	FlaggedBy   []string      `json:"flagged_by,omitempty"`
+	Replies     []*Reply      `json:"replies,omitempty"`
+	Reactions   []*Reaction   `json:"reactions,omitempty"`
+	Attachments []*Attachment `json:"attachments,omitempty"`
+}
+
+func (dp *DirectPost) addToTypedContainer(tc *typedContainer) {
+	tc.Type = "direct_post"
+	tc.DirectPost = dp
+}
+
 const MaxAttachmentsPerPost = 5
 
+// MaxDirectChannelMembers is the maximum number of members in a Mattermost
+// group message channel.
+const MaxDirectChannelMembers = 8
+
 type Attachment struct {
 	Path string `json:"path"`
 }
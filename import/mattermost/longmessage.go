@@ -0,0 +1,227 @@
+package mattermost
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/danjacques/hangouts-migrate/parse"
+	"github.com/danjacques/hangouts-migrate/util"
+)
+
+// DefaultMaxMessageLength is the default maximum length of a post's message,
+// in runes. It is Mattermost's default maximum post size; the import of a
+// longer post fails.
+const DefaultMaxMessageLength = 16383
+
+// LongMessageMode is how messages longer than the maximum length are imported.
+type LongMessageMode string
+
+const (
+	// LongMessageSplit splits a long message into consecutive posts.
+	LongMessageSplit LongMessageMode = "split"
+	// LongMessageAttach truncates a long message, and attaches its full text as
+	// a .txt file.
+	LongMessageAttach = "attach"
+)
+
+const (
+	continuedSuffix = "\n_(continued below)_"
+	continuedPrefix = "_(continued)_\n"
+)
+
+// overflowFileName returns the name of the file that holds content, the full
+// text of a long message.
+func overflowFileName(content string) string {
+	return fmt.Sprintf("message-%s.txt", util.HashForKey(content)[:16])
+}
+
+// truncatedNote returns the note that ends a message whose full text is in the
+// file named name.
+func truncatedNote(name string) string {
+	return fmt.Sprintf("\n_(message truncated; the full text is attached as %s)_", name)
+}
+
+func (big *BulkImportGenerator) maxMessageLength() int {
+	if big.MaxMessageLength > 0 {
+		return big.MaxMessageLength
+	}
+	return DefaultMaxMessageLength
+}
+
+// validateLongMessages checks that long messages can be imported as
+// configured.
+func (big *BulkImportGenerator) validateLongMessages() error {
+	// Leave room for at least some text alongside the markers.
+	var min int
+	switch big.LongMessages {
+	case "", LongMessageSplit:
+		min = len(continuedPrefix) + len(continuedSuffix) + 1
+	case LongMessageAttach:
+		if big.OverflowDir == "" {
+			return errors.New("attaching long messages requires an overflow directory")
+		}
+		min = utf8.RuneCountInString(truncatedNote(overflowFileName(""))) + 1
+	default:
+		return fmt.Errorf("unknown long message mode %q", big.LongMessages)
+	}
+	if big.maxMessageLength() < min {
+		return fmt.Errorf("maximum message length must be at least %d", min)
+	}
+	return nil
+}
+
+// fitMessage returns the posts that import p, whose message was rendered from
+// e. If p's message is too long, it is split or truncated according to
+// LongMessages; otherwise, p is returned as-is.
+func (big *BulkImportGenerator) fitMessage(p *Post, e *parse.Event) ([]*Post, error) {
+	limit := big.maxMessageLength()
+	if utf8.RuneCountInString(p.Message) <= limit {
+		return []*Post{p}, nil
+	}
+
+	if big.LongMessages == LongMessageAttach {
+		if err := big.attachMessage(p, e, limit); err != nil {
+			return nil, err
+		}
+		return []*Post{p}, nil
+	}
+
+	parts := splitMessage(p.Message, limit-len(continuedPrefix)-len(continuedSuffix))
+	posts := make([]*Post, len(parts))
+	for i, part := range parts {
+		if i > 0 {
+			part = continuedPrefix + part
+		}
+		if i < len(parts)-1 {
+			part += continuedSuffix
+		}
+
+		// Reactions and flags belong to the first part, and attachments follow
+		// the last. The parts share a timestamp, which is made unique when they
+		// are added.
+		cp := *p
+		cp.Message = part
+		if i > 0 {
+			cp.FlaggedBy, cp.Reactions = nil, nil
+		}
+		if i < len(parts)-1 {
+			cp.Attachments = nil
+		}
+		posts[i] = &cp
+	}
+	return posts, nil
+}
+
+// attachMessage writes e's full text to a file in OverflowDir and attaches it
+// to p, whose message is truncated to fit within limit.
+func (big *BulkImportGenerator) attachMessage(p *Post, e *parse.Event, limit int) error {
+	content := plainTextForEvent(e)
+	name := overflowFileName(content)
+	if err := os.MkdirAll(big.OverflowDir, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(big.OverflowDir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		return fmt.Errorf("could not write long message: %w", err)
+	}
+
+	note := truncatedNote(name)
+	p.Message = splitMessage(p.Message, limit-utf8.RuneCountInString(note))[0] + note
+	dest := filepath.Join(big.DestAttachmentDir, name)
+	big.addFile(dest, path)
+	p.Attachments = append(p.Attachments, &Attachment{
+		Path: dest,
+	})
+	return nil
+}
+
+// plainTextForEvent returns the text of e's message, without formatting.
+func plainTextForEvent(e *parse.Event) string {
+	if e.ChatMessage == nil || e.ChatMessage.MessageContent == nil {
+		return ""
+	}
+
+	var sb strings.Builder
+	for _, seg := range e.ChatMessage.MessageContent.Segment {
+		sb.WriteString(seg.Text)
+	}
+	return sb.String()
+}
+
+// markdownLinkRE matches a Markdown link, as rendered by markdownLink.
+var markdownLinkRE = regexp.MustCompile(`\[(?:\\.|[^\]\\])*\]\([^)\s]*\)`)
+
+// splitMessage splits text into parts of at most limit runes each. It prefers
+// to split between paragraphs, then lines, then words, and avoids splitting
+// code spans and links. Parts that would be empty are dropped.
+func splitMessage(text string, limit int) []string {
+	var parts []string
+	for utf8.RuneCountInString(text) > limit {
+		cut := splitPoint(text, limit)
+		if part := strings.TrimRight(text[:cut], " \n"); part != "" {
+			parts = append(parts, part)
+		}
+		text = strings.TrimLeft(text[cut:], " \n")
+	}
+	if text != "" || len(parts) == 0 {
+		parts = append(parts, text)
+	}
+	return parts
+}
+
+// splitPoint returns the byte offset at which to split text, such that the
+// text before it has at most limit runes.
+func splitPoint(text string, limit int) int {
+	end, n := len(text), 0
+	for i := range text {
+		if n == limit {
+			end = i
+			break
+		}
+		n++
+	}
+	head := text[:end]
+
+	// Code spans and links are broken by a split within them.
+	unsplittable := findCode(text)
+	for _, loc := range markdownLinkRE.FindAllStringIndex(text, -1) {
+		unsplittable = append(unsplittable, [2]int{loc[0], loc[1]})
+	}
+	within := func(i int) (int, bool) {
+		for _, r := range unsplittable {
+			if r[0] < i && i < r[1] {
+				return r[0], true
+			}
+		}
+		return 0, false
+	}
+
+	// Split at a separator, as long as it doesn't leave a very short part.
+	for _, sep := range []string{"\n\n", "\n", " "} {
+		for i := strings.LastIndex(head, sep); i > len(head)/2; i = strings.LastIndex(head[:i], sep) {
+			if _, ok := within(i); !ok {
+				return i
+			}
+		}
+	}
+
+	// Split mid-word, but before any code span or link that would be split,
+	// and not in the middle of a Markdown escape.
+	cut := end
+	if start, ok := within(cut); ok && start > 0 {
+		cut = start
+	}
+	for cut > 0 && head[cut-1] == '\\' {
+		cut--
+	}
+	if cut == 0 {
+		return end
+	}
+	return cut
+}
@@ -0,0 +1,116 @@
+package mattermost
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitMessage(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name  string
+		text  string
+		limit int
+		want  []string
+	}{
+		{
+			name:  "short",
+			text:  "hello",
+			limit: 10,
+			want:  []string{"hello"},
+		},
+		{
+			name:  "empty",
+			text:  "",
+			limit: 10,
+			want:  []string{""},
+		},
+		{
+			name:  "paragraphs",
+			text:  "first one\n\nsecond one",
+			limit: 15,
+			want:  []string{"first one", "second one"},
+		},
+		{
+			name:  "lines before words",
+			text:  "aaaa bbbb\ncccc dddd",
+			limit: 14,
+			want:  []string{"aaaa bbbb", "cccc dddd"},
+		},
+		{
+			name:  "words",
+			text:  "aaaa bbbb cccc dddd",
+			limit: 12,
+			want:  []string{"aaaa bbbb", "cccc dddd"},
+		},
+		{
+			name:  "mid-word",
+			text:  "abcdefghij",
+			limit: 4,
+			want:  []string{"abcd", "efgh", "ij"},
+		},
+		{
+			name:  "escape is kept whole",
+			text:  `abc\*defg`,
+			limit: 4,
+			want:  []string{"abc", `\*de`, "fg"},
+		},
+		{
+			name:  "multibyte",
+			text:  "ééééé",
+			limit: 2,
+			want:  []string{"éé", "éé", "é"},
+		},
+		{
+			name:  "leading whitespace",
+			text:  "            aaaa bbbb",
+			limit: 10,
+			want:  []string{"aaaa bbbb"},
+		},
+		{
+			name:  "blank lines",
+			text:  "aaaa\n\n\n\n\n\n\n\n\n\n\n\nbbbb",
+			limit: 6,
+			want:  []string{"aaaa", "bbbb"},
+		},
+		{
+			name:  "code span is kept whole",
+			text:  "see `a b c` now",
+			limit: 10,
+			want:  []string{"see", "`a b c`", "now"},
+		},
+		{
+			name:  "link is kept whole",
+			text:  "go to [the site](http://example.com) now",
+			limit: 30,
+			want:  []string{"go to", "[the site](http://example.com)", "now"},
+		},
+		{
+			name:  "link longer than the limit",
+			text:  "aaaaaa[x y](http://e.com)",
+			limit: 10,
+			want:  []string{"aaaaaa", "[x y](http", "://e.com)"},
+		},
+		{
+			name:  "code block split at a line outside of it",
+			text:  "intro line\n```\nx = 1\ny = 2\n```\nend",
+			limit: 25,
+			want:  []string{"intro line", "```\nx = 1\ny = 2\n```\nend"},
+		},
+	} {
+		got := splitMessage(tc.text, tc.limit)
+		if strings.Join(got, "|") != strings.Join(tc.want, "|") || len(got) != len(tc.want) {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+		for _, part := range got {
+			if n := utf8.RuneCountInString(part); n > tc.limit {
+				t.Errorf("%s: part %q has %d runes, more than %d", tc.name, part, n, tc.limit)
+			}
+			if part == "" && tc.text != "" {
+				t.Errorf("%s: empty part", tc.name)
+			}
+		}
+	}
+}
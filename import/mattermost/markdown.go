@@ -0,0 +1,322 @@
+package mattermost
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"unicode"
+
+	"github.com/danjacques/hangouts-migrate/parse"
+)
+
+// markdownEscaper escapes characters that Mattermost would otherwise interpret
+// as Markdown formatting.
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	`*`, `\*`,
+	`_`, `\_`,
+	`~`, `\~`,
+)
+
+// linkTextEscaper escapes link text. It is markdownEscaper, plus the brackets
+// that delimit the text.
+var linkTextEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	`*`, `\*`,
+	`_`, `\_`,
+	`~`, `\~`,
+	`[`, `\[`,
+	`]`, `\]`,
+)
+
+// linkTargetEscaper escapes characters that would terminate a Markdown link
+// target.
+var linkTargetEscaper = strings.NewReplacer(
+	`(`, `%28`,
+	`)`, `%29`,
+	` `, `%20`,
+)
+
+// renderSegments renders Hangouts message segments as Mattermost Markdown.
+//
+// Markdown shows code literally, so text within code spans and blocks is not
+// escaped or formatted. Trailing whitespace is trimmed, but leading whitespace
+// (e.g., indentation) is kept.
+func renderSegments(segs []*parse.MessageContentSegment) string {
+	// Find code in the text as a whole, since code blocks span segments.
+	texts := make([]string, len(segs))
+	var all strings.Builder
+	for i, seg := range segs {
+		texts[i] = seg.Text
+		if seg.Type == parse.SegmentTypeLineBreak {
+			texts[i] = "\n"
+		}
+		all.WriteString(texts[i])
+	}
+	code := findCode(all.String())
+
+	var sb strings.Builder
+	end := 0
+	for i, seg := range segs {
+		start := end
+		end += len(texts[i])
+
+		switch {
+		case seg.Type == parse.SegmentTypeLineBreak:
+			sb.WriteString("\n")
+		case code.overlaps(start, end):
+			sb.WriteString(code.escape(texts[i], start))
+		case seg.Type == parse.SegmentTypeLink:
+			sb.WriteString(renderLink(seg))
+		default:
+			sb.WriteString(applyFormatting(markdownEscaper.Replace(seg.Text), seg))
+		}
+	}
+	return strings.TrimRightFunc(sb.String(), unicode.IsSpace)
+}
+
+// codeRanges are the byte ranges of code within text, in order.
+type codeRanges [][2]int
+
+// findCode returns the code spans in text. A code span, or block, begins with
+// a run of backticks, and ends with the next run of the same length. A run
+// with no such match is not code.
+func findCode(text string) codeRanges {
+	var code codeRanges
+	backticks := func(i int) int {
+		n := 0
+		for i+n < len(text) && text[i+n] == '`' {
+			n++
+		}
+		return n
+	}
+
+	for i := 0; i < len(text); {
+		n := backticks(i)
+		if n == 0 {
+			i++
+			continue
+		}
+
+		end := -1
+		for j := i + n; j < len(text); {
+			m := backticks(j)
+			if m == 0 {
+				j++
+				continue
+			}
+			if m == n {
+				end = j + m
+				break
+			}
+			j += m
+		}
+		if end < 0 {
+			i += n
+			continue
+		}
+		code = append(code, [2]int{i, end})
+		i = end
+	}
+	return code
+}
+
+// overlaps returns true if the range from start to end overlaps any code.
+func (code codeRanges) overlaps(start, end int) bool {
+	for _, r := range code {
+		if r[0] < end && start < r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// escape escapes the parts of text, which begins at offset, that are not
+// code.
+func (code codeRanges) escape(text string, offset int) string {
+	var sb strings.Builder
+	pos := 0
+	for _, r := range code {
+		start, end := r[0]-offset, r[1]-offset
+		if end <= pos || start >= len(text) {
+			continue
+		}
+		if start > pos {
+			sb.WriteString(markdownEscaper.Replace(text[pos:start]))
+			pos = start
+		}
+		if end > len(text) {
+			end = len(text)
+		}
+		sb.WriteString(text[pos:end])
+		pos = end
+	}
+	sb.WriteString(markdownEscaper.Replace(text[pos:]))
+	return sb.String()
+}
+
+// renderLink renders a LINK segment. If the link's text is just its target,
+// the bare target is emitted and left for Mattermost to auto-link.
+func renderLink(seg *parse.MessageContentSegment) string {
+	var target string
+	if ld := seg.LinkData; ld != nil {
+		target = unwrapRedirect(ld.LinkTarget)
+	}
+	if target == "" {
+		return applyFormatting(markdownEscaper.Replace(seg.Text), seg)
+	}
+	if seg.Text == "" || sameLink(seg.Text, target) {
+		return applyFormatting(target, seg)
+	}
+
+	return applyFormatting(markdownLink(seg.Text, target), seg)
+}
+
+// markdownLink renders a Markdown link to target with the given text.
+func markdownLink(text, target string) string {
+	return "[" + linkTextEscaper.Replace(text) + "](" + linkTargetEscaper.Replace(target) + ")"
+}
+
+// renderEmbedItem renders a shared place or link preview ("thing") as
+// Markdown. It returns an empty string for other embed items, and for links
+// whose URL already appears in text.
+func renderEmbedItem(ei *parse.EmbedItem, text string) string {
+	switch {
+	case ei.PlaceV2 != nil:
+		return renderPlace(ei.PlaceV2, text)
+	case ei.ThingV2 != nil:
+		return renderThing(ei.ThingV2, text)
+	default:
+		return ""
+	}
+}
+
+func renderThing(t *parse.ThingV2, text string) string {
+	name, target := t.Name, unwrapRedirect(t.URL)
+	switch {
+	case target == "":
+		return markdownEscaper.Replace(name)
+	case strings.Contains(text, target):
+		return ""
+	case name == "" || sameLink(name, target):
+		return target
+	default:
+		return markdownLink(name, target)
+	}
+}
+
+// applyFormatting wraps v in the Markdown for seg's formatting.
+//
+// Markdown emphasis may not begin or end with whitespace, so any surrounding
+// whitespace is kept outside of the markers. Mattermost has no underline
+// Markdown, so underlining is dropped.
+func applyFormatting(v string, seg *parse.MessageContentSegment) string {
+	f := &seg.Formatting
+	if !(f.Bold || f.Italics || f.Strikethrough) {
+		return v
+	}
+
+	core := strings.TrimFunc(v, unicode.IsSpace)
+	if core == "" {
+		return v
+	}
+	start := strings.Index(v, core)
+	prefix, suffix := v[:start], v[start+len(core):]
+
+	if f.Strikethrough {
+		core = "~~" + core + "~~"
+	}
+	if f.Italics {
+		core = "_" + core + "_"
+	}
+	if f.Bold {
+		core = "**" + core + "**"
+	}
+	return prefix + core + suffix
+}
+
+// unwrapRedirect returns the destination of a Google redirect link
+// ("https://www.google.com/url?q=..."), or target if it is not one.
+func unwrapRedirect(target string) string {
+	u, err := url.Parse(target)
+	if err != nil {
+		return target
+	}
+	if !strings.HasSuffix(u.Host, "google.com") || u.Path != "/url" {
+		return target
+	}
+	if q := u.Query().Get("q"); q != "" {
+		return q
+	}
+	return target
+}
+
+// sameLink returns true if text and target refer to the same link, ignoring
+// scheme and trailing slashes.
+func sameLink(text, target string) bool {
+	normalize := func(v string) string {
+		if i := strings.Index(v, "://"); i >= 0 {
+			v = v[i+len("://"):]
+		}
+		return strings.TrimRight(v, "/")
+	}
+	return normalize(text) == normalize(target)
+}
+
+// renderPlace renders a shared location: its name, address, and coordinates,
+// with links to the place and to its coordinates on a map. The place's link is
+// omitted if its URL already appears in text.
+func renderPlace(p *parse.PlaceV2, text string) string {
+	var lines []string
+
+	name, target := p.Name, unwrapRedirect(p.URL)
+	if target != "" && strings.Contains(text, target) {
+		target = ""
+	}
+	switch {
+	case name != "" && target != "":
+		lines = append(lines, ":round_pushpin: "+markdownLink(name, target))
+	case name != "":
+		lines = append(lines, ":round_pushpin: **"+markdownEscaper.Replace(name)+"**")
+	case target != "":
+		lines = append(lines, ":round_pushpin: "+target)
+	}
+
+	if a := p.Address; a != nil {
+		if addr := formatAddress(&a.PostalAddressV2, name); addr != "" {
+			lines = append(lines, markdownEscaper.Replace(addr))
+		}
+	}
+
+	if g := p.Geo; g != nil {
+		c := g.GeoCoordinatesV2
+		if c.Latitude != 0 || c.Longitude != 0 {
+			coords := fmt.Sprintf("%.6f,%.6f", c.Latitude, c.Longitude)
+			mapURL := "https://www.google.com/maps/search/?api=1&query=" + coords
+			lines = append(lines, markdownLink(strings.Replace(coords, ",", ", ", 1), mapURL))
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// formatAddress formats a postal address on a single line. The address's name
+// is omitted if it is the same as the place's name.
+func formatAddress(a *parse.PostalAddressV2, placeName string) string {
+	var parts []string
+	add := func(v string) {
+		v = strings.Join(strings.Fields(strings.Replace(v, "\n", ", ", -1)), " ")
+		if v != "" {
+			parts = append(parts, v)
+		}
+	}
+
+	if a.Name != placeName {
+		add(a.Name)
+	}
+	add(a.StreetAddress)
+	add(a.AddressLocality)
+	add(strings.TrimSpace(a.AddressRegion + " " + a.PostalCode))
+	add(a.AddressCountry)
+	return strings.Join(parts, ", ")
+}
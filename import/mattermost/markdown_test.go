@@ -0,0 +1,137 @@
+package mattermost
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/danjacques/hangouts-migrate/parse"
+)
+
+func TestRenderSegments(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name string
+		// segs is the JSON-encoded segments.
+		segs string
+		want string
+	}{
+		{
+			name: "plain",
+			segs: `[{"type":"TEXT","text":"hello"}]`,
+			want: "hello",
+		},
+		{
+			name: "escaped",
+			segs: `[{"type":"TEXT","text":"a*b_c~d\\e"}]`,
+			want: `a\*b\_c\~d\\e`,
+		},
+		{
+			name: "formatting",
+			segs: `[{"type":"TEXT","text":"bold ","formatting":{"bold":true}},{"type":"TEXT","text":"it","formatting":{"italics":true}},` +
+				`{"type":"TEXT","text":" gone","formatting":{"strikethrough":true}}]`,
+			want: "**bold** _it_ ~~gone~~",
+		},
+		{
+			name: "line breaks",
+			segs: `[{"type":"TEXT","text":"a"},{"type":"LINE_BREAK","text":"\n"},{"type":"TEXT","text":"b"}]`,
+			want: "a\nb",
+		},
+		{
+			name: "leading indentation is kept",
+			segs: `[{"type":"TEXT","text":"    indented"},{"type":"LINE_BREAK","text":"\n"},{"type":"TEXT","text":"  more  "},{"type":"LINE_BREAK","text":"\n"}]`,
+			want: "    indented\n  more",
+		},
+		{
+			name: "whitespace only",
+			segs: `[{"type":"TEXT","text":" "},{"type":"LINE_BREAK","text":"\n"}]`,
+			want: "",
+		},
+		{
+			name: "code span",
+			segs: `[{"type":"TEXT","text":"run ` + "`a*b_c`" + ` or a*b"}]`,
+			want: "run `a*b_c` or a\\*b",
+		},
+		{
+			name: "double backtick code span",
+			segs: `[{"type":"TEXT","text":"` + "``a ` b*c``" + ` *"}]`,
+			want: "``a ` b*c`` \\*",
+		},
+		{
+			name: "unmatched backtick",
+			segs: `[{"type":"TEXT","text":"` + "it`s *" + `"}]`,
+			want: "it`s \\*",
+		},
+		{
+			name: "code block",
+			segs: `[{"type":"TEXT","text":"` + "```" + `"},{"type":"LINE_BREAK","text":"\n"},` +
+				`{"type":"TEXT","text":"x = a*b_c"},{"type":"LINE_BREAK","text":"\n"},` +
+				`{"type":"TEXT","text":"` + "```" + `"},{"type":"LINE_BREAK","text":"\n"},{"type":"TEXT","text":"a*b"}]`,
+			want: "```\nx = a*b_c\n```\na\\*b",
+		},
+		{
+			name: "formatted code",
+			segs: `[{"type":"TEXT","text":"` + "`a*b`" + `","formatting":{"bold":true}}]`,
+			want: "`a*b`",
+		},
+		{
+			name: "link",
+			segs: `[{"type":"LINK","text":"the site","link_data":{"link_target":"http://example.com/a_(b)"}}]`,
+			want: "[the site](http://example.com/a_%28b%29)",
+		},
+		{
+			name: "bare link",
+			segs: `[{"type":"LINK","text":"example.com","link_data":{"link_target":"http://example.com/"}}]`,
+			want: "http://example.com/",
+		},
+		{
+			name: "link with brackets",
+			segs: `[{"type":"LINK","text":"[draft] a_b]","link_data":{"link_target":"http://example.com"}}]`,
+			want: `[\[draft\] a\_b\]](http://example.com)`,
+		},
+		{
+			name: "redirect",
+			segs: `[{"type":"LINK","text":"x","link_data":{"link_target":"https://www.google.com/url?q=http://example.com/"}}]`,
+			want: "[x](http://example.com/)",
+		},
+	} {
+		var segs []*parse.MessageContentSegment
+		if err := json.Unmarshal([]byte(tc.segs), &segs); err != nil {
+			t.Fatalf("%s: bad segments: %s", tc.name, err)
+		}
+		if got := renderSegments(segs); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestFindCode(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		text string
+		want []string
+	}{
+		{"none", nil},
+		{"`a` and `b`", []string{"`a`", "`b`"}},
+		{"``a`b`` c", []string{"``a`b``"}},
+		{"`a", nil},
+		{"```\ncode\n```", []string{"```\ncode\n```"}},
+		{"``` x `y`", []string{"`y`"}},
+	} {
+		var got []string
+		for _, r := range findCode(tc.text) {
+			got = append(got, tc.text[r[0]:r[1]])
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("findCode(%q) = %q, want %q", tc.text, got, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("findCode(%q) = %q, want %q", tc.text, got, tc.want)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package mattermost
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/danjacques/hangouts-migrate/parse"
+)
+
+// eventKey identifies an event to import by its position in the conversation,
+// and orders it by its timestamp.
+type eventKey struct {
+	ts    int64 // Unix nanoseconds.
+	index int
+}
+
+// eventOrder is the order in which a conversation's events are imported:
+// by timestamp, and then by position.
+//
+// Only keys are held, so that ordering a conversation doesn't hold its events
+// in memory.
+type eventOrder []eventKey
+
+// importsEvent returns true if e is imported as a post.
+func (big *BulkImportGenerator) importsEvent(e *parse.Event) bool {
+	return e.EventType == parse.EventTypeRegularChatMessage || big.wantsSystemPost(e)
+}
+
+// orderEvents visits c's events, and returns the order in which to import
+// them.
+func (big *BulkImportGenerator) orderEvents(c parse.EventSource) (eventOrder, error) {
+	var order eventOrder
+	err := c.ForEachEvent(func(i int, e *parse.Event) error {
+		if !big.importsEvent(e) {
+			return nil
+		}
+
+		ts, err := e.Time()
+		if err != nil {
+			return fmt.Errorf("Could not get timestamp for event #%d: %w", i, err)
+		}
+		order = append(order, eventKey{ts.UnixNano(), i})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(order, func(i, j int) bool {
+		if order[i].ts != order[j].ts {
+			return order[i].ts < order[j].ts
+		}
+		return order[i].index < order[j].index
+	})
+	return order, nil
+}
+
+// forEachInOrder visits c's events again, and invokes fn for each event to
+// import, in order.
+//
+// Events are held only until it is their turn, so when c's events are mostly
+// in time order, as they usually are, few are held at once.
+func (big *BulkImportGenerator) forEachInOrder(c parse.EventSource, order eventOrder,
+	fn func(e *parse.Event, ts time.Time) error) error {
+
+	next := 0
+	pending := make(map[int]*parse.Event)
+	err := c.ForEachEvent(func(i int, e *parse.Event) error {
+		if !big.importsEvent(e) {
+			return nil
+		}
+		pending[i] = e
+
+		for next < len(order) {
+			k := order[next]
+			e, ok := pending[k.index]
+			if !ok {
+				break
+			}
+			delete(pending, k.index)
+			next++
+
+			if err := fn(e, time.Unix(0, k.ts)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if next < len(order) || len(pending) > 0 {
+		return fmt.Errorf("events of conversation %s changed between visits", conversationID(c))
+	}
+	return nil
+}
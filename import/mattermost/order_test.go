@@ -0,0 +1,85 @@
+package mattermost
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danjacques/hangouts-migrate/parse"
+)
+
+func TestEventOrder(t *testing.T) {
+	t.Parallel()
+
+	var r parse.Root
+	doc := `{"conversations":[{"conversation":{"conversation":{"id":{"id":"c1"}}},"events":[
+		{"event_id":"a","event_type":"REGULAR_CHAT_MESSAGE","timestamp":"3000"},
+		{"event_id":"b","event_type":"REGULAR_CHAT_MESSAGE","timestamp":"1000"},
+		{"event_id":"c","event_type":"ADD_USER","timestamp":"500","membership_change":{"type":"JOIN"}},
+		{"event_id":"d","event_type":"REGULAR_CHAT_MESSAGE","timestamp":"3000"},
+		{"event_id":"e","event_type":"REGULAR_CHAT_MESSAGE","timestamp":"2000"},
+		{"event_id":"f","event_type":"REGULAR_CHAT_MESSAGE","timestamp":"1000"}
+	]}]}`
+	if err := r.Decode(strings.NewReader(doc)); err != nil {
+		t.Fatalf("could not decode: %s", err)
+	}
+	c, err := r.GetConversation("c1")
+	if err != nil {
+		t.Fatalf("could not get conversation: %s", err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		big  BulkImportGenerator
+		want string
+	}{
+		{"messages", BulkImportGenerator{}, "b,f,e,a,d"},
+		{"system posts", BulkImportGenerator{SystemPosts: true}, "c,b,f,e,a,d"},
+	} {
+		order, err := tc.big.orderEvents(c)
+		if err != nil {
+			t.Fatalf("%s: could not order events: %s", tc.name, err)
+		}
+
+		var got []string
+		var last time.Time
+		err = tc.big.forEachInOrder(c, order, func(e *parse.Event, ts time.Time) error {
+			if want, _ := e.Time(); !ts.Equal(want) {
+				t.Errorf("%s: event %s visited at %s, want %s", tc.name, e.EventID, ts, want)
+			}
+			if ts.Before(last) {
+				t.Errorf("%s: event %s visited out of order", tc.name, e.EventID)
+			}
+			last = ts
+			got = append(got, e.EventID)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s: could not visit events: %s", tc.name, err)
+		}
+		if strings.Join(got, ",") != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestEventOrderBadTimestamp(t *testing.T) {
+	t.Parallel()
+
+	var r parse.Root
+	doc := `{"conversations":[{"conversation":{"conversation":{"id":{"id":"c1"}}},"events":[
+		{"event_id":"a","event_type":"REGULAR_CHAT_MESSAGE","timestamp":"soon"}
+	]}]}`
+	if err := r.Decode(strings.NewReader(doc)); err != nil {
+		t.Fatalf("could not decode: %s", err)
+	}
+	c, err := r.GetConversation("c1")
+	if err != nil {
+		t.Fatalf("could not get conversation: %s", err)
+	}
+
+	var big BulkImportGenerator
+	if _, err := big.orderEvents(c); err == nil {
+		t.Error("ordering succeeded, want error")
+	}
+}
@@ -0,0 +1,211 @@
+package mattermost
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/danjacques/hangouts-migrate/parse"
+	"github.com/danjacques/hangouts-migrate/util"
+)
+
+// Mattermost channel name limits.
+const (
+	MaxChannelNameLength        = 64
+	MaxChannelDisplayNameLength = 64
+)
+
+// conversationPlan describes how a single conversation is imported.
+type conversationPlan struct {
+	id string
+
+	channelName        string
+	channelDisplayName string
+	channelHeader      string
+	// explicitDisplayName is true if channelDisplayName was chosen by the
+	// user, rather than derived from the conversation.
+	explicitDisplayName bool
+
+	// members are the Mattermost usernames of the conversation's mapped
+	// participants, sorted.
+	members []string
+	// directMembers, if not empty, are the members of the direct channel that
+	// the conversation is imported into.
+	directMembers []string
+
+	// order is the order in which the conversation's events are imported.
+	order eventOrder
+}
+
+func (plan *conversationPlan) direct() bool { return len(plan.directMembers) > 0 }
+
+// planConversation plans the import of c.
+//
+// If channelName is empty, a unique channel name is derived from the
+// conversation and recorded in usedNames. If displayName is empty, the
+// conversation's name is used.
+func (big *BulkImportGenerator) planConversation(c parse.EventSource, channelName, displayName string,
+	usedNames map[string]struct{}) *conversationPlan {
+
+	plan := conversationPlan{
+		id:                  conversationID(c),
+		channelName:         channelName,
+		channelDisplayName:  displayName,
+		explicitDisplayName: displayName != "",
+		members:             big.conversationMembers(c),
+	}
+
+	if members, ok := big.directChannelMembers(c, plan.members); ok {
+		plan.directMembers = members
+		return &plan
+	}
+
+	if plan.channelDisplayName == "" {
+		plan.channelDisplayName = conversationDisplayName(c)
+	}
+	if plan.channelName == "" {
+		plan.channelName = uniqueChannelName(plan.channelDisplayName, plan.id, usedNames)
+	}
+	return &plan
+}
+
+// conversationID returns c's ID, or an empty string if it has none.
+func conversationID(c parse.EventSource) string {
+	if info := c.Info(); info != nil {
+		return info.ID.String()
+	}
+	return ""
+}
+
+// conversationMembers returns the sorted Mattermost usernames of c's mapped
+// participants.
+func (big *BulkImportGenerator) conversationMembers(c parse.EventSource) []string {
+	var members []string
+	seen := make(map[string]struct{})
+	for _, pd := range c.ParticipantRegistry().AllParticipants() {
+		u := big.UserMapper.UserForParticipantID(&pd.ID)
+		if u == nil {
+			continue
+		}
+		if _, ok := seen[u.Username]; ok {
+			continue
+		}
+		seen[u.Username] = struct{}{}
+		members = append(members, u.Username)
+	}
+	sort.Strings(members)
+	return members
+}
+
+// directChannelMembers returns members if c should be imported as a direct or
+// group message channel.
+//
+// One-to-one conversations become direct messages. Group conversations with
+// few enough members become group messages. Groups with only two members are
+// not converted, since Mattermost would merge them with those members' direct
+// messages.
+func (big *BulkImportGenerator) directChannelMembers(c parse.EventSource, members []string) ([]string, bool) {
+	if !big.DirectChannels {
+		return nil, false
+	}
+	info := c.Info()
+	if info == nil {
+		return nil, false
+	}
+
+	switch {
+	case info.Type == parse.ConversationTypeOneToOne && len(members) == 2:
+	case info.Type == parse.ConversationTypeGroup && len(members) > 2 && len(members) <= MaxDirectChannelMembers:
+	default:
+		return nil, false
+	}
+	return members, true
+}
+
+// conversationDisplayName returns a display name for c, using its name if it
+// has one and the names of its participants otherwise.
+func conversationDisplayName(c parse.EventSource) string {
+	var name string
+	if info := c.Info(); info != nil {
+		name = info.Name
+	}
+	if name == "" {
+		var names []string
+		for _, pd := range c.ParticipantRegistry().AllParticipants() {
+			if n := pd.DisplayName(); n != "" {
+				names = append(names, n)
+			}
+		}
+		sort.Strings(names)
+		name = strings.Join(names, ", ")
+	}
+	return truncateRunes(name, MaxChannelDisplayNameLength)
+}
+
+// uniqueChannelName derives a valid Mattermost channel name from displayName,
+// falling back on a hash of id. The name is made unique among usedNames, and
+// then added to it.
+func uniqueChannelName(displayName, id string, usedNames map[string]struct{}) string {
+	base := channelNameFor(displayName)
+	if base == "" {
+		base = "hangout-" + util.HashForKey(id)[:12]
+	}
+
+	name := base
+	for i := 2; ; i++ {
+		if _, ok := usedNames[name]; !ok {
+			break
+		}
+		suffix := fmt.Sprintf("-%d", i)
+		name = strings.TrimRight(truncateRunes(base, MaxChannelNameLength-len(suffix)), "-") + suffix
+	}
+
+	if usedNames != nil {
+		usedNames[name] = struct{}{}
+	}
+	return name
+}
+
+// channelNameFor converts v into a Mattermost channel name, consisting only of
+// lowercase letters, digits, and hyphens.
+func channelNameFor(v string) string {
+	var sb strings.Builder
+	lastHyphen := true
+	for _, r := range strings.ToLower(v) {
+		switch {
+		case (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9'):
+			sb.WriteRune(r)
+			lastHyphen = false
+		case !lastHyphen:
+			sb.WriteRune('-')
+			lastHyphen = true
+		}
+	}
+	name := truncateRunes(sb.String(), MaxChannelNameLength)
+	return strings.Trim(name, "-")
+}
+
+func truncateRunes(v string, max int) string {
+	if utf8.RuneCountInString(v) <= max {
+		return v
+	}
+	return string([]rune(v)[:max])
+}
+
+// userSet is an ordered set of users, keyed on username.
+type userSet struct {
+	users []*UserID
+	seen  map[string]struct{}
+}
+
+func (us *userSet) add(u *UserID) {
+	if _, ok := us.seen[u.Username]; ok {
+		return
+	}
+	if us.seen == nil {
+		us.seen = make(map[string]struct{})
+	}
+	us.seen[u.Username] = struct{}{}
+	us.users = append(us.users, u)
+}
@@ -0,0 +1,210 @@
+package mattermost
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/danjacques/hangouts-migrate/parse"
+)
+
+// isSystemEvent returns true if e is a conversation rename or membership
+// change.
+func isSystemEvent(e *parse.Event) bool {
+	return e.ConversationRename != nil || e.MembershipChange != nil
+}
+
+// isCallEndEvent returns true if e is the end of a voice or video call.
+func isCallEndEvent(e *parse.Event) bool {
+	return e.HangoutEvent != nil && e.HangoutEvent.EventType == parse.HangoutEventEnd
+}
+
+// wantsSystemPost returns true if e should be imported as a system post.
+func (big *BulkImportGenerator) wantsSystemPost(e *parse.Event) bool {
+	return (big.SystemPosts && isSystemEvent(e)) || (big.CallPosts && isCallEndEvent(e))
+}
+
+// systemPostAuthor returns the user that authors the system post for e. This
+// is SystemPostUser if it is set, and can post to the channel; otherwise, it is
+// the user who made the change.
+func (big *BulkImportGenerator) systemPostAuthor(e *parse.Event, direct bool) *UserID {
+	if big.systemPostUser != nil && !direct {
+		return big.systemPostUser
+	}
+	if e.SenderID == nil {
+		return nil
+	}
+	return big.UserMapper.UserForParticipantID(e.SenderID)
+}
+
+// resolveSystemPostUser looks up SystemPostUser in the user map.
+func (big *BulkImportGenerator) resolveSystemPostUser() error {
+	big.systemPostUser = nil
+	if big.SystemPostUser == "" {
+		return nil
+	}
+	for _, u := range big.UserMapper.AllUsers() {
+		if u.Username == big.SystemPostUser {
+			big.systemPostUser = u
+			return nil
+		}
+	}
+	return fmt.Errorf("system post user %q is not in the user map", big.SystemPostUser)
+}
+
+// systemEventText describes a rename, membership change, or call as post text.
+func (big *BulkImportGenerator) systemEventText(e *parse.Event, reg *parse.ParticipantRegistry) string {
+	actor := big.participantName(e.SenderID, reg)
+
+	var text string
+	switch {
+	case e.ConversationRename != nil:
+		r := e.ConversationRename
+		if r.NewName == "" {
+			text = fmt.Sprintf("%s removed the conversation name", actor)
+		} else {
+			text = fmt.Sprintf("%s renamed the conversation to “%s”", actor, r.NewName)
+		}
+
+	case e.MembershipChange != nil:
+		mc := e.MembershipChange
+		var names []string
+		self := false
+		for _, pid := range mc.ParticipantID {
+			if e.SenderID != nil && *pid == *e.SenderID {
+				self = true
+			}
+			names = append(names, big.participantName(pid, reg))
+		}
+		if len(names) == 0 {
+			return ""
+		}
+		who := joinNames(names)
+
+		switch {
+		case mc.Type == parse.MembershipChangeLeave && (self || e.SenderID == nil):
+			text = fmt.Sprintf("%s left the conversation", who)
+		case mc.Type == parse.MembershipChangeLeave:
+			text = fmt.Sprintf("%s removed %s from the conversation", actor, who)
+		case self || e.SenderID == nil:
+			text = fmt.Sprintf("%s joined the conversation", who)
+		default:
+			text = fmt.Sprintf("%s added %s to the conversation", actor, who)
+		}
+
+	case e.HangoutEvent != nil:
+		text = big.callText(e.HangoutEvent, reg)
+
+	default:
+		return ""
+	}
+	return "_" + markdownEscaper.Replace(text) + "._"
+}
+
+// callText describes a call that has ended, e.g. "Video call lasted 23m with A
+// and B".
+func (big *BulkImportGenerator) callText(he *parse.HangoutEvent, reg *parse.ParticipantRegistry) string {
+	text := "Video call"
+	if he.MediaType == parse.HangoutMediaAudioOnly {
+		text = "Voice call"
+	}
+
+	switch d, err := he.Duration(); {
+	case err != nil:
+		log.Printf("WARN: Invalid call duration %q: %s", he.HangoutDurationSecs, err)
+	case d > 0:
+		text += " lasted " + formatCallDuration(d)
+	}
+
+	if len(he.ParticipantID) > 0 {
+		names := make([]string, len(he.ParticipantID))
+		for i, pid := range he.ParticipantID {
+			names[i] = big.participantName(pid, reg)
+		}
+		text += " with " + joinNames(names)
+	}
+	return text
+}
+
+// formatCallDuration formats d to the minute ("1h 5m", "23m"), or to the second
+// if it is shorter than a minute.
+func formatCallDuration(d time.Duration) string {
+	if d < time.Minute {
+		return fmt.Sprintf("%ds", int(d/time.Second))
+	}
+	d = d.Round(time.Minute)
+	h, m := int(d/time.Hour), int(d%time.Hour/time.Minute)
+	switch {
+	case h == 0:
+		return fmt.Sprintf("%dm", m)
+	case m == 0:
+		return fmt.Sprintf("%dh", h)
+	default:
+		return fmt.Sprintf("%dh %dm", h, m)
+	}
+}
+
+// participantName returns a display name for pid.
+func (big *BulkImportGenerator) participantName(pid *parse.ParticipantID, reg *parse.ParticipantRegistry) string {
+	if pid == nil {
+		return "Someone"
+	}
+	if pd := reg.ForID(pid); pd != nil && pd.DisplayName() != "" {
+		return pd.DisplayName()
+	}
+	if u := big.UserMapper.UserForParticipantID(pid); u != nil {
+		return "@" + u.Username
+	}
+	return "Someone"
+}
+
+// joinNames joins names as an English list ("A, B and C").
+func joinNames(names []string) string {
+	if len(names) == 1 {
+		return names[0]
+	}
+	return strings.Join(names[:len(names)-1], ", ") + " and " + names[len(names)-1]
+}
+
+// applyRenames visits each planned channel conversation's events, and names
+// the channel after its final rename. The channel's header records the
+// conversation's previous name.
+//
+// Channels whose display names were explicitly chosen are not renamed.
+func (big *BulkImportGenerator) applyRenames(plansByID map[string]*conversationPlan,
+	forEach func(fn func(c parse.EventSource) error) error) error {
+
+	return forEach(func(c parse.EventSource) error {
+		plan := plansByID[conversationID(c)]
+		if plan == nil || plan.direct() {
+			return nil
+		}
+
+		var last *parse.ConversationRename
+		var lastTime time.Time
+		err := c.ForEachEvent(func(i int, e *parse.Event) error {
+			if r := e.ConversationRename; r != nil && r.NewName != "" {
+				ts, err := e.Time()
+				if err != nil {
+					return fmt.Errorf("Could not get timestamp for event #%d: %w", i, err)
+				}
+				if last == nil || !ts.Before(lastTime) {
+					last, lastTime = r, ts
+				}
+			}
+			return nil
+		})
+		if err != nil || last == nil {
+			return err
+		}
+
+		if !plan.explicitDisplayName {
+			plan.channelDisplayName = truncateRunes(last.NewName, MaxChannelDisplayNameLength)
+		}
+		if last.OldName != "" {
+			plan.channelHeader = fmt.Sprintf("Formerly “%s”", last.OldName)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,83 @@
+package mattermost
+
+import (
+	"time"
+)
+
+// MaxRepliesPerThread is the maximum number of replies that are added to a
+// single thread. Mattermost imports a thread as a single JSONL line, whose
+// size it bounds, so longer bursts are split into several threads.
+const MaxRepliesPerThread = 500
+
+// threader adds posts to a channel. If ThreadGap is set, it groups posts into
+// bursts, and adds each burst as a root post with the rest as its replies.
+type threader struct {
+	big           *BulkImportGenerator
+	w             *BulkImportWriter
+	directMembers []string
+	createAts     *createAtAllocator
+
+	root    *Post
+	replies []*Post
+	lastAt  time.Time
+}
+
+// add adds p, which was posted at ts, followed by replies to it. Posts must be
+// added in time order.
+//
+// The timestamps of p and its replies, and those of their reactions, are made
+// unique. If p is itself added as a reply, its replies follow it in the same
+// thread.
+func (t *threader) add(p *Post, ts time.Time, replies ...*Post) error {
+	t.createAts.assign(p)
+	for _, r := range replies {
+		t.createAts.assign(r)
+	}
+
+	gap := t.big.ThreadGap
+	if gap <= 0 {
+		p.Replies = append(p.Replies, repliesForPosts(replies)...)
+		return t.big.addPost(t.w, p, t.directMembers)
+	}
+
+	if t.root != nil && ts.Sub(t.lastAt) < gap && len(t.replies)+1+len(replies) <= MaxRepliesPerThread {
+		t.replies = append(t.replies, p)
+		t.replies = append(t.replies, replies...)
+		t.lastAt = ts
+		return nil
+	}
+
+	if err := t.flush(); err != nil {
+		return err
+	}
+	t.root, t.replies, t.lastAt = p, replies, ts
+	return nil
+}
+
+// flush adds the current thread, if there is one.
+func (t *threader) flush() error {
+	if t.root == nil {
+		return nil
+	}
+
+	root := t.root
+	root.Replies = append(root.Replies, repliesForPosts(t.replies)...)
+	t.root, t.replies = nil, nil
+	return t.big.addPost(t.w, root, t.directMembers)
+}
+
+// repliesForPosts converts posts into replies.
+func repliesForPosts(posts []*Post) []*Reply {
+	replies := make([]*Reply, len(posts))
+	for i, p := range posts {
+		replies[i] = &Reply{
+			User:        p.User,
+			Message:     p.Message,
+			CreateAt:    p.CreateAt,
+			FlaggedBy:   p.FlaggedBy,
+			Reactions:   p.Reactions,
+			Attachments: p.Attachments,
+		}
+	}
+	return replies
+}
@@ -0,0 +1,63 @@
+package mattermost
+
+import (
+	"strings"
+)
+
+// createAtAllocator assigns unique timestamps to a channel's posts.
+//
+// Mattermost treats posts in a channel with the same user and timestamp as
+// duplicates. Hangouts timestamps have microsecond precision, but Mattermost's
+// have millisecond precision, so posts made in quick succession can collide.
+type createAtAllocator struct {
+	used map[int64]struct{}
+	last int64
+}
+
+// createAtAllocator returns the allocator for the channel named channelName or,
+// if directMembers is not empty, the direct channel between directMembers.
+//
+// A channel may import several conversations. Each conversation's posts must
+// be assigned in time order, and the allocator's ordering is reset for each.
+func (big *BulkImportGenerator) createAtAllocator(channelName string, directMembers []string) *createAtAllocator {
+	key := channelName
+	if len(directMembers) > 0 {
+		key = "direct:" + strings.Join(directMembers, ",")
+	}
+
+	if big.createAts == nil {
+		big.createAts = make(map[string]*createAtAllocator)
+	}
+	a := big.createAts[key]
+	if a == nil {
+		a = &createAtAllocator{used: make(map[int64]struct{})}
+		big.createAts[key] = a
+	}
+	a.last = 0
+	return a
+}
+
+// assign nudges p's timestamp forward, if necessary, so that it is unused and
+// follows the previously-assigned post. p's reactions are nudged so that each
+// follows p and the reaction before it.
+func (a *createAtAllocator) assign(p *Post) {
+	at := p.CreateAt
+	if at <= a.last {
+		at = a.last + 1
+	}
+	for {
+		if _, ok := a.used[at]; !ok {
+			break
+		}
+		at++
+	}
+	a.used[at] = struct{}{}
+	p.CreateAt, a.last = at, at
+
+	for _, r := range p.Reactions {
+		if r.CreateAt <= at {
+			r.CreateAt = at + 1
+		}
+		at = r.CreateAt
+	}
+}
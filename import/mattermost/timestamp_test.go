@@ -0,0 +1,97 @@
+package mattermost
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCreateAtAllocator(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name string
+		in   []int64
+		want []int64
+	}{
+		{"unique", []int64{1, 5, 9}, []int64{1, 5, 9}},
+		{"same", []int64{5, 5, 5}, []int64{5, 6, 7}},
+		{"crowded", []int64{5, 5, 6, 6, 10}, []int64{5, 6, 7, 8, 10}},
+		{"out of order", []int64{5, 3, 4}, []int64{5, 6, 7}},
+	} {
+		var big BulkImportGenerator
+		a := big.createAtAllocator("channel", nil)
+
+		var got []int64
+		for _, at := range tc.in {
+			p := Post{CreateAt: at}
+			a.assign(&p)
+			got = append(got, p.CreateAt)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestCreateAtAllocatorReactions(t *testing.T) {
+	t.Parallel()
+
+	var big BulkImportGenerator
+	a := big.createAtAllocator("channel", nil)
+
+	first := Post{CreateAt: 10}
+	a.assign(&first)
+
+	p := Post{
+		CreateAt: 10,
+		Reactions: []*Reaction{
+			{CreateAt: 5},
+			{CreateAt: 20},
+			{CreateAt: 20},
+		},
+	}
+	a.assign(&p)
+	got := []int64{p.CreateAt}
+	for _, r := range p.Reactions {
+		got = append(got, r.CreateAt)
+	}
+	if want := []int64{11, 12, 20, 21}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestCreateAtAllocatorChannels(t *testing.T) {
+	t.Parallel()
+
+	var big BulkImportGenerator
+	assign := func(a *createAtAllocator, at int64) int64 {
+		p := Post{CreateAt: at}
+		a.assign(&p)
+		return p.CreateAt
+	}
+
+	// Channels are independent.
+	if got := assign(big.createAtAllocator("a", nil), 10); got != 10 {
+		t.Errorf("first post in a is at %d, want 10", got)
+	}
+	if got := assign(big.createAtAllocator("b", nil), 10); got != 10 {
+		t.Errorf("first post in b is at %d, want 10", got)
+	}
+	if got := assign(big.createAtAllocator("", []string{"x", "y"}), 10); got != 10 {
+		t.Errorf("first direct post is at %d, want 10", got)
+	}
+
+	// A second conversation in the same channel avoids the first's
+	// timestamps, but needn't follow them.
+	a := big.createAtAllocator("a", nil)
+	if got := assign(a, 20); got != 20 {
+		t.Errorf("later post in a is at %d, want 20", got)
+	}
+	a = big.createAtAllocator("a", nil)
+	if got := assign(a, 10); got != 11 {
+		t.Errorf("post in a's second conversation is at %d, want 11", got)
+	}
+	if got := assign(a, 15); got != 15 {
+		t.Errorf("next post in a's second conversation is at %d, want 15", got)
+	}
+}
@@ -1,17 +1,129 @@
 package parse
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
+	"math"
 	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 )
 
+type CookieFormat string
+
+const (
+	// CookieFormatAuto detects the format from the content.
+	CookieFormatAuto CookieFormat = "auto"
+	// CookieFormatHeader is a Cookie header value ("name=value; name=value").
+	// These cookies have no domain, and are sent to Google hosts.
+	CookieFormatHeader = "header"
+	// CookieFormatNetscape is the Netscape cookies.txt format, as exported by
+	// curl and many browser extensions.
+	CookieFormatNetscape = "netscape"
+	// CookieFormatJSON is a JSON array of cookies, as exported by browser
+	// extensions such as EditThisCookie.
+	CookieFormatJSON = "json"
+)
+
+// LoadCookies loads cookies from r in the given format. Expired cookies are
+// reported and discarded.
+func LoadCookies(r io.Reader, format CookieFormat) ([]*http.Cookie, error) {
+	d, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read data: %w", err)
+	}
+
+	if format == CookieFormatAuto {
+		format = detectCookieFormat(d)
+	}
+
+	var cookies []*http.Cookie
+	switch format {
+	case CookieFormatHeader:
+		cookies, err = LoadCookieJarFromText(bytes.NewReader(d))
+	case CookieFormatNetscape:
+		cookies, err = LoadNetscapeCookies(bytes.NewReader(d))
+	case CookieFormatJSON:
+		cookies, err = LoadCookieJarFromJSON(bytes.NewReader(d))
+	default:
+		return nil, fmt.Errorf("unknown cookie format %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	live := cookies[:0]
+	for _, c := range cookies {
+		if !c.Expires.IsZero() && c.Expires.Before(now) {
+			log.Printf("WARNING: Cookie %q for %q expired at %s; discarding.", c.Name, c.Domain, c.Expires)
+			continue
+		}
+		live = append(live, c)
+	}
+	return live, nil
+}
+
+func detectCookieFormat(d []byte) CookieFormat {
+	d = bytes.TrimSpace(d)
+	switch {
+	case bytes.HasPrefix(d, []byte("[")):
+		return CookieFormatJSON
+	case bytes.HasPrefix(d, []byte("#")), bytes.Contains(d, []byte("\t")):
+		return CookieFormatNetscape
+	default:
+		return CookieFormatHeader
+	}
+}
+
+// NewCookieJar returns a cookie jar holding cookies, each scoped to its Domain
+// and Path. Cookies without a Domain are not added.
+//
+// The jar does not distinguish host-only cookies, so each cookie is also sent
+// to subdomains of its Domain.
+func NewCookieJar(cookies []*http.Cookie) (http.CookieJar, error) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range cookies {
+		host := strings.TrimPrefix(c.Domain, ".")
+		if host == "" {
+			continue
+		}
+
+		u := url.URL{Scheme: "http", Host: host, Path: c.Path}
+		if c.Secure {
+			u.Scheme = "https"
+		}
+		if u.Path == "" {
+			u.Path = "/"
+		}
+		jar.SetCookies(&u, []*http.Cookie{c})
+	}
+	return jar, nil
+}
+
 type cookieJSON struct {
 	Name  string `json:"name"`
 	Value string `json:"value"`
+
+	Domain   string `json:"domain"`
+	Path     string `json:"path"`
+	Secure   bool   `json:"secure"`
+	HTTPOnly bool   `json:"httpOnly"`
+	// ExpirationDate is in seconds since the epoch. It is absent for session
+	// cookies.
+	ExpirationDate float64 `json:"expirationDate"`
 }
 
 func LoadCookieJarFromJSON(r io.Reader) ([]*http.Cookie, error) {
@@ -24,9 +136,65 @@ func LoadCookieJarFromJSON(r io.Reader) ([]*http.Cookie, error) {
 	cookies := make([]*http.Cookie, len(data))
 	for i, c := range data {
 		cookies[i] = &http.Cookie{
-			Name:  c.Name,
-			Value: c.Value,
+			Name:     c.Name,
+			Value:    c.Value,
+			Domain:   c.Domain,
+			Path:     c.Path,
+			Secure:   c.Secure,
+			HttpOnly: c.HTTPOnly,
 		}
+		if c.ExpirationDate > 0 {
+			secs, frac := math.Modf(c.ExpirationDate)
+			cookies[i].Expires = time.Unix(int64(secs), int64(frac*float64(time.Second)))
+		}
+	}
+	return cookies, nil
+}
+
+// LoadNetscapeCookies loads cookies in the Netscape cookies.txt format. Each
+// line holds tab-separated domain, include-subdomains flag, path, secure flag,
+// expiry (seconds since the epoch, or 0 for session cookies), name, and value.
+func LoadNetscapeCookies(r io.Reader) ([]*http.Cookie, error) {
+	const httpOnlyPrefix = "#HttpOnly_"
+
+	var cookies []*http.Cookie
+	s := bufio.NewScanner(r)
+	for lineNo := 1; s.Scan(); lineNo++ {
+		line := strings.TrimRight(s.Text(), "\r")
+
+		httpOnly := false
+		if strings.HasPrefix(line, httpOnlyPrefix) {
+			line = strings.TrimPrefix(line, httpOnlyPrefix)
+			httpOnly = true
+		}
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			return nil, fmt.Errorf("line %d: expected 7 fields, got %d", lineNo, len(fields))
+		}
+		expiry, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid expiry %q: %w", lineNo, fields[4], err)
+		}
+
+		c := http.Cookie{
+			Domain:   fields[0],
+			Path:     fields[2],
+			Secure:   strings.EqualFold(fields[3], "TRUE"),
+			Name:     fields[5],
+			Value:    fields[6],
+			HttpOnly: httpOnly,
+		}
+		if expiry > 0 {
+			c.Expires = time.Unix(expiry, 0)
+		}
+		cookies = append(cookies, &c)
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read data: %w", err)
 	}
 	return cookies, nil
 }
@@ -0,0 +1,166 @@
+package parse
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// describeCookies describes cookies for comparison.
+func describeCookies(cookies []*http.Cookie) []string {
+	var descs []string
+	for _, c := range cookies {
+		desc := c.Name + "=" + c.Value + " domain=" + c.Domain + " path=" + c.Path
+		if c.Secure {
+			desc += " secure"
+		}
+		if c.HttpOnly {
+			desc += " httponly"
+		}
+		if !c.Expires.IsZero() {
+			desc += " expires=" + c.Expires.UTC().Format(time.RFC3339)
+		}
+		descs = append(descs, desc)
+	}
+	return descs
+}
+
+func TestLoadCookies(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name   string
+		format CookieFormat
+		data   string
+		want   []string
+	}{
+		{
+			name:   "header",
+			format: CookieFormatHeader,
+			data:   "SID=abc; HSID=def=ghi",
+			want:   []string{"SID=abc domain= path=", "HSID=def=ghi domain= path="},
+		},
+		{
+			name:   "netscape",
+			format: CookieFormatNetscape,
+			data: "# Netscape HTTP Cookie File\n\n" +
+				".google.com\tTRUE\t/\tTRUE\t4102444800\tSID\tabc\n" +
+				"#HttpOnly_photos.google.com\tFALSE\t/p\tFALSE\t0\tHSID\tdef\r\n",
+			want: []string{
+				"SID=abc domain=.google.com path=/ secure expires=2100-01-01T00:00:00Z",
+				"HSID=def domain=photos.google.com path=/p httponly",
+			},
+		},
+		{
+			name:   "netscape expired",
+			format: CookieFormatNetscape,
+			data: ".google.com\tTRUE\t/\tTRUE\t4102444800\tSID\tabc\n" +
+				".google.com\tTRUE\t/\tTRUE\t946684800\tOLD\tdef\n",
+			want: []string{"SID=abc domain=.google.com path=/ secure expires=2100-01-01T00:00:00Z"},
+		},
+		{
+			name:   "json",
+			format: CookieFormatJSON,
+			data: `[{"name":"SID","value":"abc","domain":".google.com","path":"/","secure":true,"httpOnly":true,"expirationDate":4102444800.5},` +
+				`{"name":"S","value":"x","domain":"mail.google.com","path":"/"}]`,
+			want: []string{
+				"SID=abc domain=.google.com path=/ secure httponly expires=2100-01-01T00:00:00Z",
+				"S=x domain=mail.google.com path=/",
+			},
+		},
+		{
+			name:   "auto json",
+			format: CookieFormatAuto,
+			data:   ` [{"name":"SID","value":"abc","domain":".google.com"}]`,
+			want:   []string{"SID=abc domain=.google.com path="},
+		},
+		{
+			name:   "auto netscape",
+			format: CookieFormatAuto,
+			data:   ".google.com\tTRUE\t/\tFALSE\t0\tSID\tabc\n",
+			want:   []string{"SID=abc domain=.google.com path=/"},
+		},
+		{
+			name:   "auto header",
+			format: CookieFormatAuto,
+			data:   "SID=abc\n",
+			want:   []string{"SID=abc domain= path="},
+		},
+	} {
+		cookies, err := LoadCookies(strings.NewReader(tc.data), tc.format)
+		if err != nil {
+			t.Errorf("%s: could not load: %s", tc.name, err)
+			continue
+		}
+		if got := describeCookies(cookies); strings.Join(got, "\n") != strings.Join(tc.want, "\n") {
+			t.Errorf("%s: got:\n%s\nwant:\n%s", tc.name, strings.Join(got, "\n"), strings.Join(tc.want, "\n"))
+		}
+	}
+}
+
+func TestLoadCookiesInvalid(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name   string
+		format CookieFormat
+		data   string
+	}{
+		{"header without value", CookieFormatHeader, "SID"},
+		{"netscape fields", CookieFormatNetscape, ".google.com\tTRUE\t/\tFALSE\tSID\tabc\n"},
+		{"netscape expiry", CookieFormatNetscape, ".google.com\tTRUE\t/\tFALSE\tsoon\tSID\tabc\n"},
+		{"json", CookieFormatJSON, `{"name":"SID"}`},
+		{"unknown format", CookieFormat("yaml"), "SID=abc"},
+	} {
+		if _, err := LoadCookies(strings.NewReader(tc.data), tc.format); err == nil {
+			t.Errorf("%s: loaded, want error", tc.name)
+		}
+	}
+}
+
+func TestSessionCookieScoping(t *testing.T) {
+	t.Parallel()
+
+	cookies := []*http.Cookie{
+		{Name: "SID", Value: "1", Domain: ".google.com", Path: "/"},
+		{Name: "PHOTOS", Value: "2", Domain: "photos.google.com", Path: "/"},
+		{Name: "SECURE", Value: "3", Domain: ".googleusercontent.com", Path: "/", Secure: true},
+		{Name: "BARE", Value: "4"},
+	}
+	var s session
+	if err := s.setCookies(cookies); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		url  string
+		want string
+	}{
+		{"https://google.com/", "BARE,SID"},
+		{"https://www.google.com/", "BARE,SID"},
+		{"https://photos.google.com/a", "BARE,PHOTOS,SID"},
+		{"https://lh3.googleusercontent.com/x", "BARE,SECURE"},
+		{"http://lh3.googleusercontent.com/x", "BARE"},
+		{"https://LH3.GoogleUserContent.com./x", "BARE,SECURE"},
+		{"https://example.com/", ""},
+		{"https://notgoogle.com/", ""},
+		{"https://google.com.example.com/", ""},
+		{"http://127.0.0.1:8080/", ""},
+	} {
+		u, err := url.Parse(tc.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, c := range append(s.Cookies(u), s.unscopedCookies(u)...) {
+			names = append(names, c.Name)
+		}
+		sort.Strings(names)
+		if got := strings.Join(names, ","); got != tc.want {
+			t.Errorf("cookies for %s are %q, want %q", tc.url, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,428 @@
+package parse
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Google Chat Takeout exports are a directory tree:
+//
+//	Google Chat/
+//	  Groups/
+//	    <group ID>/
+//	      group_info.json
+//	      messages.json
+//	      <attachment files>
+//
+// Each group is presented as an EventSource, so that it can be consumed in the
+// same way as a Hangouts conversation.
+
+var _ EventSource = (*GoogleChatGroup)(nil)
+
+const (
+	googleChatGroupsDir     = "Groups"
+	googleChatGroupInfoFile = "group_info.json"
+	googleChatMessagesFile  = "messages.json"
+
+	// googleChatDMPrefix is the group directory prefix used for direct
+	// messages, both one-to-one and group.
+	googleChatDMPrefix = "DM "
+)
+
+// Layouts of Google Chat message timestamps, e.g.:
+// "Thursday, March 24, 2022 at 6:01:15 PM UTC"
+const (
+	googleChatTimeLayout       = "Monday, January 2, 2006 at 3:04:05 PM MST"
+	googleChatTimeOffsetLayout = "Monday, January 2, 2006 at 3:04:05 PM -0700"
+)
+
+// googleChatTimeZones maps the time zone abbreviations that Google Chat
+// timestamps use to a location that defines them. time.Parse only knows the
+// offsets of UTC and of the local time zone's abbreviations, and silently uses
+// a zero offset for any other.
+var googleChatTimeZones = map[string]string{
+	"UTC": "UTC",
+	"GMT": "UTC",
+
+	"PST": "America/Los_Angeles", "PDT": "America/Los_Angeles",
+	"MST": "America/Denver", "MDT": "America/Denver",
+	"CST": "America/Chicago", "CDT": "America/Chicago",
+	"EST": "America/New_York", "EDT": "America/New_York",
+	"AKST": "America/Anchorage", "AKDT": "America/Anchorage",
+	"HST": "Pacific/Honolulu",
+
+	"BST": "Europe/London",
+	"WET": "Europe/Lisbon", "WEST": "Europe/Lisbon",
+	"CET": "Europe/Paris", "CEST": "Europe/Paris",
+	"EET": "Europe/Athens", "EEST": "Europe/Athens",
+
+	"IST":  "Asia/Kolkata",
+	"SGT":  "Asia/Singapore",
+	"HKT":  "Asia/Hong_Kong",
+	"JST":  "Asia/Tokyo",
+	"KST":  "Asia/Seoul",
+	"AWST": "Australia/Perth",
+	"ACST": "Australia/Adelaide", "ACDT": "Australia/Adelaide",
+	"AEST": "Australia/Sydney", "AEDT": "Australia/Sydney",
+	"NZST": "Pacific/Auckland", "NZDT": "Pacific/Auckland",
+}
+
+var (
+	googleChatLocationsMu sync.Mutex
+	googleChatLocations   = make(map[string]*time.Location)
+)
+
+// googleChatLocation returns the location that defines the time zone
+// abbreviation abbrev.
+func googleChatLocation(abbrev string) (*time.Location, error) {
+	name, ok := googleChatTimeZones[abbrev]
+	if !ok {
+		return nil, fmt.Errorf("unknown time zone %q", abbrev)
+	}
+
+	googleChatLocationsMu.Lock()
+	defer googleChatLocationsMu.Unlock()
+	if loc := googleChatLocations[name]; loc != nil {
+		return loc, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("could not load time zone %q: %w", abbrev, err)
+	}
+	googleChatLocations[name] = loc
+	return loc, nil
+}
+
+type googleChatUser struct {
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	UserType string `json:"user_type"`
+}
+
+func (u *googleChatUser) participantID() ParticipantID {
+	// Google Chat does not expose Gaia IDs. Use the user's e-mail address as
+	// their chat ID, falling back on their name.
+	if u.Email != "" {
+		return ParticipantID{ChatID: u.Email}
+	}
+	return ParticipantID{ChatID: u.Name}
+}
+
+type googleChatGroupInfo struct {
+	Name    string            `json:"name"`
+	Members []*googleChatUser `json:"members"`
+}
+
+type googleChatAttachedFile struct {
+	OriginalName string `json:"original_name"`
+	ExportName   string `json:"export_name"`
+}
+
+type googleChatMessage struct {
+	Creator       *googleChatUser           `json:"creator"`
+	CreatedDate   string                    `json:"created_date"`
+	Text          string                    `json:"text"`
+	TopicID       string                    `json:"topic_id"`
+	MessageID     string                    `json:"message_id"`
+	AttachedFiles []*googleChatAttachedFile `json:"attached_files"`
+}
+
+// IsGoogleChatExport returns true if path is a directory, and so should be read
+// as a Google Chat Takeout export rather than as a Hangouts JSON file.
+func IsGoogleChatExport(path string) bool {
+	st, err := os.Stat(path)
+	return err == nil && st.IsDir()
+}
+
+// ForEachGoogleChatGroup walks the Google Chat Takeout export at base, invoking
+// fn for each group in turn. base may be either the "Google Chat" directory or
+// its "Groups" subdirectory.
+//
+// If fn returns StopIteration, iteration ends and ForEachGoogleChatGroup
+// returns nil.
+func ForEachGoogleChatGroup(base string, fn func(g *GoogleChatGroup) error) error {
+	groupsDir := filepath.Join(base, googleChatGroupsDir)
+	if _, err := os.Stat(groupsDir); err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		groupsDir = base
+	}
+
+	entries, err := ioutil.ReadDir(groupsDir)
+	if err != nil {
+		return fmt.Errorf("could not list groups in %s: %w", groupsDir, err)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	for _, ent := range entries {
+		if !ent.IsDir() {
+			continue
+		}
+
+		g, err := LoadGoogleChatGroup(filepath.Join(groupsDir, ent.Name()))
+		if err != nil {
+			return err
+		}
+
+		switch err := fn(g); err {
+		case nil:
+		case StopIteration:
+			return nil
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// GoogleChatGroup is a single Google Chat group (space or direct message)
+// loaded from a Takeout export directory.
+type GoogleChatGroup struct {
+	dir  string
+	info *ConversationInfo
+	reg  ParticipantRegistry
+}
+
+// LoadGoogleChatGroup loads the group metadata in dir. The group's messages are
+// scanned for their senders, so that former members are known, but are not
+// otherwise loaded until ForEachEvent is called.
+func LoadGoogleChatGroup(dir string) (*GoogleChatGroup, error) {
+	var gi googleChatGroupInfo
+	infoPath := filepath.Join(dir, googleChatGroupInfoFile)
+	data, err := ioutil.ReadFile(infoPath)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &gi); err != nil {
+			return nil, fmt.Errorf("could not decode %s: %w", infoPath, err)
+		}
+	case os.IsNotExist(err):
+		// Some groups have no metadata.
+	default:
+		return nil, err
+	}
+
+	id := filepath.Base(dir)
+	g := GoogleChatGroup{
+		dir: dir,
+		info: &ConversationInfo{
+			ID:   &SingleID{ID: id},
+			Type: ConversationTypeGroup,
+			Name: gi.Name,
+		},
+	}
+	var memberNames []string
+	for _, m := range gi.Members {
+		pd := g.addParticipant(m)
+		g.info.CurrentParticipant = append(g.info.CurrentParticipant, &pd.ID)
+		memberNames = append(memberNames, m.Name)
+	}
+	if g.info.Name == "" {
+		// Direct messages don't have names; name them after their members.
+		g.info.Name = strings.Join(memberNames, ", ")
+	}
+
+	// Register senders who are no longer members.
+	err = g.forEachMessage(func(i int, dec *json.Decoder) error {
+		var msg struct {
+			Creator *googleChatUser `json:"creator"`
+		}
+		if err := dec.Decode(&msg); err != nil {
+			return fmt.Errorf("could not decode message #%d: %w", i, err)
+		}
+		if msg.Creator != nil {
+			g.addParticipant(msg.Creator)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Direct messages between more than two people are group conversations.
+	if strings.HasPrefix(id, googleChatDMPrefix) && len(g.info.ParticipantData) <= 2 {
+		g.info.Type = ConversationTypeOneToOne
+	}
+
+	return &g, nil
+}
+
+func (g *GoogleChatGroup) addParticipant(u *googleChatUser) *ParticipantData {
+	pid := u.participantID()
+	if pd := g.reg.ForID(&pid); pd != nil {
+		return pd
+	}
+
+	pd := &ParticipantData{
+		ID:              pid,
+		FallbackName:    u.Name,
+		ParticipantType: u.UserType,
+	}
+	g.info.ParticipantData = append(g.info.ParticipantData, pd)
+	g.reg.Register(pd)
+	return pd
+}
+
+func (g *GoogleChatGroup) Info() *ConversationInfo { return g.info }
+
+// ParticipantRegistry returns the group's participants, including former
+// members who only appear as message senders.
+func (g *GoogleChatGroup) ParticipantRegistry() *ParticipantRegistry { return &g.reg }
+
+// ForEachEvent streams the group's messages.json, converting each message into
+// an Event and invoking fn with it.
+//
+// If fn returns StopIteration, iteration ends and ForEachEvent returns nil.
+func (g *GoogleChatGroup) ForEachEvent(fn func(i int, e *Event) error) error {
+	return g.forEachMessage(func(i int, dec *json.Decoder) error {
+		var msg googleChatMessage
+		if err := dec.Decode(&msg); err != nil {
+			return fmt.Errorf("could not decode message #%d: %w", i, err)
+		}
+
+		e, err := g.eventForMessage(&msg)
+		if err != nil {
+			return fmt.Errorf("could not convert message #%d: %w", i, err)
+		}
+		return fn(i, e)
+	})
+}
+
+// forEachMessage streams the group's messages.json, invoking fn to decode each
+// message from dec in turn.
+//
+// If fn returns StopIteration, iteration ends and forEachMessage returns nil.
+func (g *GoogleChatGroup) forEachMessage(fn func(i int, dec *json.Decoder) error) error {
+	path := filepath.Join(g.dir, googleChatMessagesFile)
+	fd, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// No messages.
+			return nil
+		}
+		return err
+	}
+	defer fd.Close()
+
+	dec := json.NewDecoder(fd)
+	if err := expectDelim(dec, '{'); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for dec.More() {
+		key, err := readKey(dec)
+		if err != nil {
+			return err
+		}
+		if key != "messages" {
+			if err := skipValue(dec); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := expectDelim(dec, '['); err != nil {
+			return fmt.Errorf("%s: messages: %w", path, err)
+		}
+		for i := 0; dec.More(); i++ {
+			switch err := fn(i, dec); err {
+			case nil:
+			case StopIteration:
+				return nil
+			default:
+				return err
+			}
+		}
+		if err := expectDelim(dec, ']'); err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, '}')
+}
+
+func (g *GoogleChatGroup) eventForMessage(msg *googleChatMessage) (*Event, error) {
+	ts, err := parseGoogleChatTime(msg.CreatedDate)
+	if err != nil {
+		return nil, err
+	}
+
+	e := Event{
+		ConversationID: g.info.ID,
+		Timestamp:      strconv.FormatInt(ts.UnixNano()/int64(time.Microsecond), 10),
+		EventID:        msg.MessageID,
+		EventType:      EventTypeRegularChatMessage,
+	}
+	if msg.Creator != nil {
+		e.SenderID = &g.addParticipant(msg.Creator).ID
+	}
+
+	var mc MessageContent
+	for i, line := range strings.Split(msg.Text, "\n") {
+		if i > 0 {
+			mc.Segment = append(mc.Segment, &MessageContentSegment{
+				Type: SegmentTypeLineBreak,
+				Text: "\n",
+			})
+		}
+		if line != "" {
+			mc.Segment = append(mc.Segment, &MessageContentSegment{
+				Type: SegmentTypeText,
+				Text: line,
+			})
+		}
+	}
+
+	for _, af := range msg.AttachedFiles {
+		if af.ExportName == "" {
+			continue
+		}
+		key := g.info.ID.ID + "/" + af.ExportName
+		mc.Attachment = append(mc.Attachment, &MessageContentAttachment{
+			ID: key,
+			EmbedItem: &EmbedItem{
+				Type: []EmbedItemType{EmbedItemLocalFile},
+				ID:   key,
+				LocalFile: &LocalFile{
+					Path: filepath.Join(g.dir, af.ExportName),
+					Name: af.OriginalName,
+				},
+			},
+		})
+	}
+
+	e.ChatMessage = &ChatMessage{MessageContent: &mc}
+	return &e, nil
+}
+
+func parseGoogleChatTime(v string) (time.Time, error) {
+	// Newer exports use a narrow no-break space before the AM/PM marker.
+	v = strings.Replace(v, "\u202f", " ", -1)
+
+	if t, err := time.Parse(googleChatTimeOffsetLayout, v); err == nil {
+		return t, nil
+	}
+
+	// Resolve the time zone abbreviation in a location that defines it.
+	abbrev := v[strings.LastIndexByte(v, ' ')+1:]
+	loc, err := googleChatLocation(abbrev)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("timestamp %q: %w", v, err)
+	}
+	t, err := time.ParseInLocation(googleChatTimeLayout, v, loc)
+	if err != nil {
+		return time.Time{}, errors.New("unrecognized timestamp: " + v)
+	}
+	if t.Location() != loc && loc != time.UTC {
+		// loc doesn't define the abbreviation, so its offset is unknown.
+		return time.Time{}, fmt.Errorf("timestamp %q: time zone %q is not defined by %s", v, abbrev, loc)
+	}
+	return t, nil
+}
@@ -0,0 +1,138 @@
+package parse
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseGoogleChatTime(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		v    string
+		want string
+	}{
+		{"Thursday, March 24, 2022 at 6:01:15 PM UTC", "2022-03-24T18:01:15Z"},
+		{"Thursday, March 24, 2022 at 6:01:15 PM GMT", "2022-03-24T18:01:15Z"},
+		{"Thursday, March 24, 2022 at 6:01:15\u202fPM UTC", "2022-03-24T18:01:15Z"},
+		{"Monday, January 10, 2022 at 9:30:00 AM PST", "2022-01-10T17:30:00Z"},
+		{"Sunday, July 10, 2022 at 9:30:00 AM PDT", "2022-07-10T16:30:00Z"},
+		{"Monday, January 10, 2022 at 9:30:00 AM EST", "2022-01-10T14:30:00Z"},
+		{"Monday, January 10, 2022 at 9:30:00 AM CET", "2022-01-10T08:30:00Z"},
+		{"Sunday, July 10, 2022 at 9:30:00 AM CEST", "2022-07-10T07:30:00Z"},
+		{"Monday, January 10, 2022 at 9:30:00 AM IST", "2022-01-10T04:00:00Z"},
+		{"Monday, January 10, 2022 at 9:30:00 AM AEDT", "2022-01-09T22:30:00Z"},
+		{"Monday, January 10, 2022 at 9:30:00 AM +0530", "2022-01-10T04:00:00Z"},
+	} {
+		got, err := parseGoogleChatTime(tc.v)
+		if err != nil {
+			t.Errorf("parseGoogleChatTime(%q) failed: %s", tc.v, err)
+			continue
+		}
+		if s := got.UTC().Format(time.RFC3339); s != tc.want {
+			t.Errorf("parseGoogleChatTime(%q) = %s, want %s", tc.v, s, tc.want)
+		}
+	}
+
+	for _, v := range []string{
+		"Monday, January 10, 2022 at 9:30:00 AM XYZ",
+		"Monday, January 10, 2022 at 9:30:00 AM",
+		"2022-01-10T09:30:00Z",
+		"",
+	} {
+		if got, err := parseGoogleChatTime(v); err == nil {
+			t.Errorf("parseGoogleChatTime(%q) = %s, want error", v, got)
+		}
+	}
+}
+
+// writeGoogleChatGroup writes a group to dir, whose members are named by
+// members and whose messages are sent by senders.
+func writeGoogleChatGroup(t *testing.T, dir string, members, senders []string) {
+	t.Helper()
+
+	user := func(name string) string {
+		return `{"name":"` + name + `","email":"` + strings.ToLower(name) + `@example.com","user_type":"Human"}`
+	}
+	var ms, msgs []string
+	for _, m := range members {
+		ms = append(ms, user(m))
+	}
+	for i, s := range senders {
+		msgs = append(msgs, `{"creator":`+user(s)+`,"created_date":"Thursday, March 24, 2022 at 6:0`+
+			string(rune('0'+i))+`:15 PM UTC","text":"hi","message_id":"m`+string(rune('0'+i))+`"}`)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	info := `{"members":[` + strings.Join(ms, ",") + `]}`
+	if err := ioutil.WriteFile(filepath.Join(dir, googleChatGroupInfoFile), []byte(info), 0644); err != nil {
+		t.Fatal(err)
+	}
+	messages := `{"messages":[` + strings.Join(msgs, ",") + `]}`
+	if err := ioutil.WriteFile(filepath.Join(dir, googleChatMessagesFile), []byte(messages), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadGoogleChatGroup(t *testing.T) {
+	t.Parallel()
+
+	base, err := ioutil.TempDir("", "googlechat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+
+	for _, tc := range []struct {
+		name     string
+		members  []string
+		senders  []string
+		wantType string
+		wantName string
+		// wantParticipants is the number of participants, including former
+		// members.
+		wantParticipants int
+	}{
+		{"DM one", []string{"Alice", "Bob"}, []string{"Alice", "Bob"}, ConversationTypeOneToOne, "Alice, Bob", 2},
+		{"DM group", []string{"Alice", "Bob", "Carol"}, []string{"Alice"}, ConversationTypeGroup, "Alice, Bob, Carol", 3},
+		{"DM former", []string{"Alice", "Bob"}, []string{"Alice", "Dan"}, ConversationTypeGroup, "Alice, Bob", 3},
+		{"Space", []string{"Alice", "Bob"}, []string{"Carol"}, ConversationTypeGroup, "Alice, Bob", 3},
+	} {
+		dir := filepath.Join(base, tc.name)
+		writeGoogleChatGroup(t, dir, tc.members, tc.senders)
+
+		g, err := LoadGoogleChatGroup(dir)
+		if err != nil {
+			t.Errorf("%s: could not load: %s", tc.name, err)
+			continue
+		}
+		info := g.Info()
+		if info.Type != tc.wantType {
+			t.Errorf("%s: type is %q, want %q", tc.name, info.Type, tc.wantType)
+		}
+		if info.Name != tc.wantName {
+			t.Errorf("%s: name is %q, want %q", tc.name, info.Name, tc.wantName)
+		}
+		if n := len(g.ParticipantRegistry().AllParticipants()); n != tc.wantParticipants {
+			t.Errorf("%s: %d participants, want %d", tc.name, n, tc.wantParticipants)
+		}
+
+		var senders []string
+		err = g.ForEachEvent(func(i int, e *Event) error {
+			senders = append(senders, e.SenderID.ChatID)
+			return nil
+		})
+		if err != nil {
+			t.Errorf("%s: could not visit events: %s", tc.name, err)
+		}
+		if len(senders) != len(tc.senders) {
+			t.Errorf("%s: got %d events, want %d", tc.name, len(senders), len(tc.senders))
+		}
+	}
+}
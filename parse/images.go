@@ -1,15 +1,18 @@
 package parse
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"math"
 	"mime"
 	"net/http"
-	"net/url"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/danjacques/hangouts-migrate/attachment"
@@ -34,6 +37,20 @@ func downloadURLSForEmbedItem(ei *EmbedItem) (urls []string) {
 		}
 	}
 
+	// Local files (e.g., from Google Chat exports) are read from disk.
+	if lf := ei.LocalFile; lf != nil && lf.Path != "" {
+		urls = append(urls, lf.URL())
+	}
+
+	// If it's a place, does it have an image URL?
+	if p := ei.PlaceV2; p != nil {
+		if io := p.ImageObjectV2; io != nil {
+			if u := io.URL; u != "" {
+				urls = append(urls, u)
+			}
+		}
+	}
+
 	// If it's a thing, does it have an image URL?
 	if t := ei.ThingV2; t != nil {
 		if ri := t.RepresentativeImage; ri != nil {
@@ -45,42 +62,172 @@ func downloadURLSForEmbedItem(ei *EmbedItem) (urls []string) {
 		}
 	}
 
+	// A bare image.
+	if io := ei.ImageObjectV2; io != nil {
+		if u := io.URL; u != "" {
+			urls = append(urls, u)
+		}
+	}
+
 	return
 }
 
+// DefaultRetryMax is the default number of times to retry a request.
+const DefaultRetryMax = 8
+
 type ImageDownloader struct {
 	AttachmentMapper *attachment.Mapper
 	Concurrency      int
-	Cookies          []*http.Cookie
+
+	// LocalRoot, if not empty, is the directory from which local attachments
+	// (e.g., those of a Google Chat export) may be read. Local files outside of
+	// it, or all local files if it is empty, cannot be downloaded.
+	LocalRoot string
+
+	// Cookies are sent with requests. Cookies with a Domain are only sent to
+	// matching hosts; cookies without one are only sent to Google hosts
+	// (google.com, googleusercontent.com, and their subdomains).
+	Cookies []*http.Cookie
+	// ReloadCookies, if not nil, is called to obtain fresh cookies when the
+	// session expires; downloads are paused until it returns. If it is nil, or
+	// returns an error, downloads are abandoned with SessionExpired.
+	ReloadCookies func(ctx context.Context) ([]*http.Cookie, error)
+
+	// RetryFailed, if true, only downloads attachments that have a recorded
+	// failure.
+	RetryFailed bool
+	// MaxAttempts, if positive, skips attachments that have already failed this
+	// many times.
+	MaxAttempts int
+	// RetryMax is the number of times to retry a request for a single URL. If
+	// zero, DefaultRetryMax is used.
+	RetryMax int
+
+	// HostRate, if positive, limits the number of requests per second to each
+	// host. HostBurst is the number of requests that may be made at once before
+	// the limit applies.
+	HostRate  float64
+	HostBurst int
+	// AdaptiveConcurrency, if true, reduces concurrency when servers throttle
+	// requests, and restores it as requests succeed.
+	AdaptiveConcurrency bool
 
 	initOnce sync.Once
-	sem      semaphore
+	conc     *concurrencyLimiter
+	queue    jobQueue
+	jobs     sync.WaitGroup
 	client   *retryablehttp.Client
+	session  session
+	progress progressCounters
 }
 
-type work struct {
-	url url.URL
+// downloadJob is a single attachment to download.
+type downloadJob struct {
+	// ctx cancels the download.
+	ctx  context.Context
+	key  string
+	urls []string
+
+	// conversationID and eventID identify the event that the attachment belongs
+	// to.
+	conversationID string
+	eventID        string
+}
+
+// jobQueue holds the jobs that are waiting for a download slot. While it is not
+// empty, a goroutine dispatches its jobs.
+type jobQueue struct {
+	mu          sync.Mutex
+	jobs        []*downloadJob
+	dispatching bool
+}
+
+// push adds job to the queue. It returns true if the caller must start a
+// goroutine to dispatch the queue.
+func (q *jobQueue) push(job *downloadJob) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.jobs = append(q.jobs, job)
+	if q.dispatching {
+		return false
+	}
+	q.dispatching = true
+	return true
+}
+
+// pop removes the next job from the queue. It returns nil if the queue is
+// empty, in which case the dispatching goroutine must exit.
+func (q *jobQueue) pop() *downloadJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.jobs) == 0 {
+		q.dispatching = false
+		return nil
+	}
+	job := q.jobs[0]
+	q.jobs[0] = nil
+	q.jobs = q.jobs[1:]
+	return job
 }
 
 func (d *ImageDownloader) initialize() {
 	d.initOnce.Do(func() {
-		d.sem = make(semaphore, d.Concurrency)
+		d.conc = newConcurrencyLimiter(d.Concurrency, d.AdaptiveConcurrency)
 
 		d.client = retryablehttp.NewClient()
-		d.client.Backoff = retryablehttp.DefaultBackoff
+		d.client.Backoff = retryAfterBackoff
 		d.client.RetryWaitMin = time.Second * 5
 		d.client.RetryWaitMax = time.Minute * 1
-		d.client.RetryMax = math.MaxInt32
+		d.client.RetryMax = d.RetryMax
+		if d.client.RetryMax <= 0 {
+			d.client.RetryMax = DefaultRetryMax
+		}
 		d.client.CheckRetry = retryPolicy
+
+		// Support "downloading" local attachments via "file://" URLs, but only
+		// from within LocalRoot.
+		if t, ok := d.client.HTTPClient.Transport.(*http.Transport); ok && d.LocalRoot != "" {
+			if lft, err := newLocalFileTransport(d.LocalRoot); err != nil {
+				log.Printf("ERROR: Could not serve local files from %s: %s", d.LocalRoot, err)
+			} else {
+				t.RegisterProtocol("file", lft)
+			}
+		}
+
+		// Scope cookies to their domains.
+		d.session.reload = d.ReloadCookies
+		if err := d.session.setCookies(d.Cookies); err != nil {
+			log.Printf("ERROR: Could not create cookie jar: %s", err)
+		}
+		d.client.HTTPClient.Jar = &d.session
+
+		d.client.HTTPClient.Transport = &throttledTransport{
+			base:  d.client.HTTPClient.Transport,
+			hosts: &hostLimiter{rate: d.HostRate, burst: d.HostBurst},
+			conc:  d.conc,
+		}
 	})
 }
 
-func (d *ImageDownloader) Add(ei *EmbedItem) bool {
+// Add queues the attachment ei, which belongs to e, for download. It returns
+// true if a download was queued. Add does not block; queued downloads start as
+// download slots become available.
+//
+// The download is cancelled, or never started, if ctx is cancelled.
+func (d *ImageDownloader) Add(ctx context.Context, e *Event, ei *EmbedItem) bool {
 	d.initialize()
+	d.progress.start()
+	if d.session.Err() != nil {
+		return false
+	}
+	atomic.AddInt64(&d.progress.total, 1)
 
 	switch path, err := d.AttachmentMapper.ScanPathForKey(ei.Key()); err {
 	case nil:
 		log.Printf("INFO: File for %s already exists, skipping: %s", ei.Key(), path)
+		atomic.AddInt64(&d.progress.skipped, 1)
 		return false
 	case attachment.NotFound:
 		break
@@ -88,44 +235,189 @@ func (d *ImageDownloader) Add(ei *EmbedItem) bool {
 		log.Printf("ERROR: Could not scan for key %s, downloading anyway: %s", ei.Key(), err)
 	}
 
+	if f := d.AttachmentMapper.GetFailure(ei.Key()); f != nil {
+		if d.MaxAttempts > 0 && f.Attempts >= d.MaxAttempts {
+			log.Printf("INFO: Download for %s failed %d time(s), skipping.", ei.Key(), f.Attempts)
+			atomic.AddInt64(&d.progress.skipped, 1)
+			return false
+		}
+	} else if d.RetryFailed {
+		atomic.AddInt64(&d.progress.skipped, 1)
+		return false
+	}
+
 	urls := downloadURLSForEmbedItem(ei)
+	if len(urls) == 0 && (ei.PlaceV2 != nil || ei.ThingV2 != nil) {
+		// Places and things don't always have images; they are rendered as
+		// message content instead.
+		atomic.AddInt64(&d.progress.skipped, 1)
+		return false
+	}
 	if len(urls) == 0 {
 		// No download URL.
 		log.Printf("WARN: Don't know how to get URL for:\n%+v", ei)
+		atomic.AddInt64(&d.progress.failed, 1)
 		return false
 	}
 
-	d.sem.Acquire()
+	job := downloadJob{
+		ctx:            ctx,
+		key:            ei.Key(),
+		urls:           urls,
+		conversationID: e.ConversationID.String(),
+		eventID:        e.EventID,
+	}
+
+	d.jobs.Add(1)
+	atomic.AddInt64(&d.progress.queued, 1)
+	if d.queue.push(&job) {
+		go d.dispatch()
+	}
+	return true
+}
+
+// dispatch starts the queued downloads as download slots become available,
+// until the queue is empty.
+func (d *ImageDownloader) dispatch() {
+	for job := d.queue.pop(); job != nil; job = d.queue.pop() {
+		d.start(job)
+	}
+}
+
+// start waits for a download slot, and then starts downloading job. The job is
+// dropped if it is cancelled, or downloads are abandoned, before it starts.
+func (d *ImageDownloader) start(job *downloadJob) {
+	err := d.session.Err()
+	if err == nil {
+		err = d.conc.acquire(job.ctx)
+	}
+	atomic.AddInt64(&d.progress.queued, -1)
+	if err != nil {
+		d.jobs.Done()
+		return
+	}
+
+	atomic.AddInt64(&d.progress.inFlight, 1)
 	go func() {
-		defer d.sem.Release()
-		d.downloadURL(ei.Key(), urls)
+		defer func() {
+			atomic.AddInt64(&d.progress.inFlight, -1)
+			d.conc.release()
+			d.jobs.Done()
+		}()
+		d.downloadURL(job.ctx, job)
 	}()
-	return true
 }
 
-func (d *ImageDownloader) Wait() {
-	d.sem.Wait()
+// Wait blocks until all queued downloads have completed. If ctx is cancelled,
+// Wait still blocks until cancelled downloads have cleaned up, and then returns
+// ctx's error. If downloads were abandoned, Wait returns the reason (see Err).
+func (d *ImageDownloader) Wait(ctx context.Context) error {
+	d.initialize()
+	atomic.StoreInt32(&d.progress.complete, 1)
+	d.jobs.Wait()
+	if err := d.Err(); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// Err returns the error that downloads were abandoned with, if any. Once
+// abandoned, no further downloads are started.
+func (d *ImageDownloader) Err() error {
+	d.initialize()
+	return d.session.Err()
 }
 
-func (d *ImageDownloader) downloadURL(key string, urls []string) {
-	for i, u := range urls {
-		if err := d.tryDownloadURL(key, u); err != nil {
-			log.Printf("Failed to download key #%d %q at: %s: %s", i, key, u, err)
+func (d *ImageDownloader) downloadURL(ctx context.Context, job *downloadJob) {
+	f := attachment.Failure{
+		URLs:           job.urls,
+		ConversationID: job.conversationID,
+		EventID:        job.eventID,
+	}
+	for i, u := range job.urls {
+		err := d.tryDownloadURL(ctx, job, u)
+		for retries := 0; err == errSessionRenewed && retries < maxSessionRetries; retries++ {
+			err = d.tryDownloadURL(ctx, job, u)
+		}
+		if err == attachment.Exists {
+			atomic.AddInt64(&d.progress.skipped, 1)
+			return
+		}
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, SessionExpired) {
+				// Cancelled; this is not a failure of the attachment.
+				log.Printf("Cancelled download of key %q.", job.key)
+				return
+			}
+			log.Printf("Failed to download key #%d %q at: %s: %s", i, job.key, u, err)
+			f.Errors = append(f.Errors, &attachment.URLError{URL: u, Error: err.Error()})
 			continue
 		}
+		atomic.AddInt64(&d.progress.done, 1)
 		return
 	}
-	log.Printf("unable to download meaningful content for key %s, tried: %v", key, urls)
+	log.Printf("unable to download meaningful content for key %s, tried: %v", job.key, job.urls)
+	atomic.AddInt64(&d.progress.failed, 1)
+
+	if err := d.AttachmentMapper.RecordFailure(job.key, &f); err != nil {
+		log.Printf("ERROR: Could not record failure for key %s: %s", job.key, err)
+	}
+}
+
+// maxSessionRetries is the number of times to retry a URL after the session has
+// been renewed.
+const maxSessionRetries = 2
+
+// errResumeRejected is returned by fetchURL when a partial download could not
+// be resumed.
+var errResumeRejected = errors.New("resume rejected")
+
+// partialDownload is a partial download to resume.
+type partialDownload struct {
+	info   *attachment.PartialInfo
+	offset int64
+}
+
+func (d *ImageDownloader) tryDownloadURL(ctx context.Context, job *downloadJob, u string) error {
+	// Resume a partial download from this URL, if there is one.
+	if pi, size := d.AttachmentMapper.Partial(job.key); pi != nil && pi.SourceURL == u {
+		log.Printf("Resuming download of %q at byte %d from: %s", job.key, size, u)
+		err := d.fetchURL(ctx, job, u, &partialDownload{info: pi, offset: size})
+		if err != errResumeRejected {
+			return err
+		}
+
+		log.Printf("Could not resume download of %q; starting over.", job.key)
+		if err := d.AttachmentMapper.DiscardPartial(job.key); err != nil {
+			log.Printf("WARN: Could not discard partial download of %q: %s", job.key, err)
+		}
+	}
+	return d.fetchURL(ctx, job, u, nil)
 }
 
-func (d *ImageDownloader) tryDownloadURL(key, u string) error {
+// fetchURL downloads u into job's attachment. If resume is not nil, the
+// download continues from the end of that partial download.
+func (d *ImageDownloader) fetchURL(ctx context.Context, job *downloadJob, u string, resume *partialDownload) error {
+	key := job.key
+
 	req, err := retryablehttp.NewRequest("GET", u, nil)
 	if err != nil {
 		return fmt.Errorf("could not create request: %w", err)
 	}
-	for _, cookie := range d.Cookies {
+	req = req.WithContext(ctx)
+	for _, cookie := range d.session.unscopedCookies(req.URL) {
 		req.AddCookie(cookie)
 	}
+	if resume != nil {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", resume.offset))
+		req.Header.Set("If-Range", ifRangeValidator(resume.info))
+	}
+
+	// Don't make requests while the session is being renewed.
+	gen, err := d.session.wait(ctx)
+	if err != nil {
+		return err
+	}
 
 	resp, err := d.client.Do(req)
 	if err != nil {
@@ -134,58 +426,187 @@ func (d *ImageDownloader) tryDownloadURL(key, u string) error {
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
+	// Peek at the start of the body, for sniffing.
+	br := bufio.NewReaderSize(resp.Body, attachment.SniffLen)
+	head, err := br.Peek(attachment.SniffLen)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("could not read response body: %w", err)
+	}
+
+	if err := d.session.checkResponse(ctx, gen, resp, head); err != nil {
+		return err
+	}
+
+	var (
+		body      io.Reader
+		mediaType string
+		pi        *attachment.PartialInfo
+	)
+	switch {
+	case resume != nil:
+		// The server must send the rest of the same content, or we start over.
+		if resp.StatusCode != http.StatusPartialContent {
+			log.Printf("Server did not resume %q, status code %d: %s", key, resp.StatusCode, resp.Status)
+			return errResumeRejected
+		}
+		if err := validateResumeResponse(resp, resume); err != nil {
+			log.Printf("Server did not resume %q: %s", key, err)
+			return errResumeRejected
+		}
+		body, mediaType, pi = br, resume.info.MediaType, resume.info
+
+	case resp.StatusCode != http.StatusOK:
 		return fmt.Errorf("download failed, non-OK status code %d: %s", resp.StatusCode, resp.Status)
+
+	default:
+		// Sniff the start of the body to determine its real media type; servers
+		// often report a generic or wrong Content-Type.
+		mediaType = chooseMediaType(getMediaType(resp), attachment.SniffMediaType(head))
+		if mediaType == "text/html" {
+			// No attachments should be HTML, this is likely an error page.
+			return fmt.Errorf("got media type %q, probably error page", mediaType)
+		}
+		body, pi = br, partialInfoForResponse(u, mediaType, resp)
 	}
 
 	// Open a writer for |key|. This also does an atomicity check to make sure
 	// we don't download the same key more than once.
-	mediaType := getMediaType(resp)
-	if mediaType == "text/html" {
-		// No attachments should be HTML, this is likely an error page.
-		return fmt.Errorf("got media type %q, probably error page", mediaType)
+	var w *attachment.Writer
+	if resume != nil {
+		w, err = d.AttachmentMapper.ResumeWriter(key, resume.info)
+	} else {
+		w, err = d.AttachmentMapper.OpenWriter(key, mediaType)
 	}
-
-	w, err := d.AttachmentMapper.OpenWriter(key, mediaType)
 	if err == attachment.Exists {
 		log.Printf("An attachment already exists for %q, skipping.", key)
-		return nil
+		return err
 	} else if err != nil {
 		log.Printf("ERROR: Failed to create attachment writer for %q: %s", key, err)
 		return fmt.Errorf("could not open writer for %q: %w", key, err)
 	}
 	defer func() {
 		if w != nil {
-			w.Close()
+			w.Abort()
 		}
 	}()
 
+	// If the server supports it, keep partial content on failure so the
+	// download can be resumed.
+	w.SetPartialInfo(pi)
+
+	// Record where this attachment came from.
+	ent := w.Entry()
+	ent.SourceURL = u
+	ent.HTTPStatus = resp.StatusCode
+	ent.ConversationID = job.conversationID
+	ent.EventID = job.eventID
+
 	const blockSize = 4 * 1024 * 1024
 	buf := make([]byte, blockSize)
-	written, err := io.CopyBuffer(w, resp.Body, buf)
-	if err != nil && err != io.EOF {
+	body = &countingReader{r: body, count: &d.progress.bytes}
+	if _, err := io.CopyBuffer(w, body, buf); err != nil && err != io.EOF {
 		log.Printf("Could not write file for %s: %s", key, err)
 		return err
 	}
 
+	// Make sure that we got all of the content.
+	if pi != nil && pi.ContentLength > 0 && w.Offset() != pi.ContentLength {
+		if w.Offset() > pi.ContentLength {
+			// Too much content; this can't be resumed.
+			w.SetPartialInfo(nil)
+		}
+		return fmt.Errorf("incomplete download, got %d of %d byte(s)", w.Offset(), pi.ContentLength)
+	}
+
 	// Close FD, we care about the error here.
 	if err := w.Close(); err != nil {
 		log.Printf("Could not close writer for %s: %s", key, err)
 		return err
 	}
 
-	log.Printf("Successfully downloaded %s (%s) (%d byte(s)) from: %s\nto: %s", key, mediaType, written, u, w.Path())
+	log.Printf("Successfully downloaded %s (%s) (%d byte(s)) from: %s\nto: %s", key, mediaType, w.Offset(), u, w.Path())
 	w = nil // Do not close in defer.
 
 	return nil
 }
 
+// partialInfoForResponse returns the PartialInfo needed to resume downloading
+// resp, or nil if the server does not support resuming it.
+func partialInfoForResponse(u, mediaType string, resp *http.Response) *attachment.PartialInfo {
+	if resp.Header.Get("Accept-Ranges") != "bytes" {
+		return nil
+	}
+
+	pi := attachment.PartialInfo{
+		SourceURL:    u,
+		MediaType:    mediaType,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+	if resp.ContentLength > 0 {
+		pi.ContentLength = resp.ContentLength
+	}
+	if ifRangeValidator(&pi) == "" {
+		// Without a validator, we can't tell whether the content has changed.
+		return nil
+	}
+	return &pi
+}
+
+// ifRangeValidator returns the If-Range header value for pi. Only strong ETags
+// may be used with If-Range.
+func ifRangeValidator(pi *attachment.PartialInfo) string {
+	if pi.ETag != "" && !strings.HasPrefix(pi.ETag, "W/") {
+		return pi.ETag
+	}
+	return pi.LastModified
+}
+
+// validateResumeResponse checks that resp continues the partial download
+// resume.
+func validateResumeResponse(resp *http.Response, resume *partialDownload) error {
+	if etag := resp.Header.Get("ETag"); etag != "" && resume.info.ETag != "" && etag != resume.info.ETag {
+		return fmt.Errorf("ETag changed from %s to %s", resume.info.ETag, etag)
+	}
+
+	// Content-Range: bytes <start>-<end>/<total|*>
+	var start, end int64
+	var total string
+	cr := resp.Header.Get("Content-Range")
+	if _, err := fmt.Sscanf(cr, "bytes %d-%d/%s", &start, &end, &total); err != nil {
+		return fmt.Errorf("invalid Content-Range %q: %w", cr, err)
+	}
+	if start != resume.offset {
+		return fmt.Errorf("range starts at %d, expected %d", start, resume.offset)
+	}
+	if total == "*" {
+		return nil
+	}
+	n, err := strconv.ParseInt(total, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid Content-Range %q: %w", cr, err)
+	}
+	if resume.info.ContentLength > 0 && n != resume.info.ContentLength {
+		return fmt.Errorf("content length is %d, expected %d", n, resume.info.ContentLength)
+	}
+	resume.info.ContentLength = n
+	return nil
+}
+
 // Augment defualt retry policy w/ TooManyRequests.
 func retryPolicy(ctx context.Context, resp *http.Response, err error) (bool, error) {
+	if errors.Is(err, errOutsideLocalRoot) {
+		return false, nil
+	}
 	if retry, err := retryablehttp.DefaultRetryPolicy(ctx, resp, err); retry || err != nil {
 		return retry, err
 	}
 
+	// Errors that aren't worth retrying (e.g., too many redirects) have no
+	// response.
+	if resp == nil {
+		return false, nil
+	}
 	if resp.StatusCode == http.StatusTooManyRequests {
 		return true, nil
 	}
@@ -193,6 +614,20 @@ func retryPolicy(ctx context.Context, resp *http.Response, err error) (bool, err
 	return false, nil
 }
 
+// chooseMediaType picks between the media type reported by the server and the
+// one sniffed from the content. Sniffed types are preferred when they are
+// definitive.
+func chooseMediaType(reported, sniffed string) string {
+	switch {
+	case attachment.IsDefinitiveMediaType(sniffed):
+		return sniffed
+	case reported != "":
+		return reported
+	default:
+		return sniffed
+	}
+}
+
 func getMediaType(resp *http.Response) string {
 	if contentType := resp.Header.Get("Content-Type"); contentType != "" {
 		if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
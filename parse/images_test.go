@@ -0,0 +1,45 @@
+package parse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	t.Parallel()
+
+	urlError := func(err error) error {
+		return &url.Error{Op: "Get", URL: "https://example.com/a", Err: err}
+	}
+	for _, tc := range []struct {
+		name   string
+		status int
+		err    error
+		want   bool
+	}{
+		{name: "ok", status: http.StatusOK},
+		{name: "not found", status: http.StatusNotFound},
+		{name: "throttled", status: http.StatusTooManyRequests, want: true},
+		{name: "server error", status: http.StatusInternalServerError, want: true},
+		{name: "too many redirects", err: urlError(errors.New("stopped after 10 redirects"))},
+		{name: "unsupported scheme", err: urlError(errors.New(`unsupported protocol scheme "ftp"`))},
+		{name: "outside local root", err: urlError(fmt.Errorf("%w: /etc/passwd", errOutsideLocalRoot))},
+		{name: "connection error", err: urlError(errors.New("connection reset")), want: true},
+	} {
+		var resp *http.Response
+		if tc.status != 0 {
+			resp = &http.Response{StatusCode: tc.status, Header: make(http.Header)}
+		}
+		got, err := retryPolicy(context.Background(), resp, tc.err)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.name, err)
+		}
+		if got != tc.want {
+			t.Errorf("%s: retry is %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package parse
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// errOutsideLocalRoot is returned when a local file outside of the local root
+// is requested.
+var errOutsideLocalRoot = errors.New("local file is outside of the export")
+
+// localFileTransport serves "file://" URLs for files within root, such as the
+// attachments of a Google Chat export. Requests for any other file fail.
+type localFileTransport struct {
+	root string
+	base http.RoundTripper
+}
+
+func newLocalFileTransport(root string) (*localFileTransport, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	if resolved, err := filepath.EvalSymlinks(root); err == nil {
+		root = resolved
+	}
+	return &localFileTransport{
+		root: root,
+		base: http.NewFileTransport(http.Dir(root)),
+	}, nil
+}
+
+func (t *localFileTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rel, err := t.relPath(filepath.FromSlash(req.URL.Path))
+	if err != nil {
+		return nil, err
+	}
+
+	req = req.Clone(req.Context())
+	req.URL.Path = "/" + filepath.ToSlash(rel)
+	return t.base.RoundTrip(req)
+}
+
+// relPath returns path relative to t.root, or an error if path, or the file
+// that it links to, is outside of t.root.
+func (t *localFileTransport) relPath(path string) (string, error) {
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	rel, err := filepath.Rel(t.root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%w: %s is not in %s", errOutsideLocalRoot, path, t.root)
+	}
+	return rel, nil
+}
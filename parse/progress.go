@@ -0,0 +1,222 @@
+package parse
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Progress is a snapshot of an ImageDownloader's progress.
+type Progress struct {
+	// Total is the number of attachments found so far. It is final once
+	// Complete is true.
+	Total int64 `json:"total"`
+	// Remaining is the number of attachments found so far that have not been
+	// downloaded, skipped, or failed.
+	Remaining int64 `json:"remaining"`
+
+	// Queued is the number of attachments waiting for a download slot.
+	Queued int64 `json:"queued"`
+	// InFlight is the number of attachments being downloaded.
+	InFlight int64 `json:"in_flight"`
+	// Done is the number of attachments that were downloaded.
+	Done int64 `json:"done"`
+	// Skipped is the number of attachments that were not downloaded, because
+	// they already exist or were excluded.
+	Skipped int64 `json:"skipped"`
+	// Failed is the number of attachments that could not be downloaded.
+	Failed int64 `json:"failed"`
+
+	// Bytes is the number of bytes transferred.
+	Bytes int64 `json:"bytes"`
+	// BytesPerSecond is the average throughput since downloading started.
+	BytesPerSecond float64 `json:"bytes_per_second"`
+
+	// Elapsed is the time since downloading started.
+	Elapsed time.Duration `json:"elapsed_ns"`
+	// ETA estimates the time until the Remaining attachments are downloaded,
+	// from the rate at which attachments have finished so far. Until Complete,
+	// more attachments may be found.
+	ETA time.Duration `json:"eta_ns,omitempty"`
+	// Complete is true once all attachments have been added.
+	Complete bool `json:"complete"`
+
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (p *Progress) String() string {
+	var sb strings.Builder
+	total := fmt.Sprint(p.Total)
+	if !p.Complete {
+		total += "+"
+	}
+	fmt.Fprintf(&sb, "%d of %s remaining (%d done, %d skipped, %d failed, %d in flight, %d queued); %s at %s/s",
+		p.Remaining, total, p.Done, p.Skipped, p.Failed, p.InFlight, p.Queued,
+		formatBytes(float64(p.Bytes)), formatBytes(p.BytesPerSecond))
+	if eta := p.ETA.Round(time.Second); eta > 0 {
+		fmt.Fprintf(&sb, "; ETA %s", eta)
+	}
+	return sb.String()
+}
+
+func formatBytes(n float64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%.0f B", n)
+	}
+	exp := 0
+	for n >= unit*unit && exp < 4 {
+		n /= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", n/unit, "KMGTP"[exp])
+}
+
+// progressCounters are updated atomically by an ImageDownloader.
+type progressCounters struct {
+	total    int64
+	queued   int64
+	inFlight int64
+	done     int64
+	skipped  int64
+	failed   int64
+	bytes    int64
+
+	// started is the time of the first Add, in Unix nanoseconds.
+	started int64
+	// complete is non-zero once Wait has been called.
+	complete int32
+}
+
+func (pc *progressCounters) start() {
+	atomic.CompareAndSwapInt64(&pc.started, 0, time.Now().UnixNano())
+}
+
+func (pc *progressCounters) snapshot() *Progress {
+	now := time.Now()
+	p := Progress{
+		Total:     atomic.LoadInt64(&pc.total),
+		Queued:    atomic.LoadInt64(&pc.queued),
+		InFlight:  atomic.LoadInt64(&pc.inFlight),
+		Done:      atomic.LoadInt64(&pc.done),
+		Skipped:   atomic.LoadInt64(&pc.skipped),
+		Failed:    atomic.LoadInt64(&pc.failed),
+		Bytes:     atomic.LoadInt64(&pc.bytes),
+		Complete:  atomic.LoadInt32(&pc.complete) != 0,
+		UpdatedAt: now.UTC(),
+	}
+	if p.Remaining = p.Total - p.Done - p.Skipped - p.Failed; p.Remaining < 0 {
+		p.Remaining = 0
+	}
+	if started := atomic.LoadInt64(&pc.started); started != 0 {
+		p.Elapsed = now.Sub(time.Unix(0, started))
+	}
+	if secs := p.Elapsed.Seconds(); secs > 0 {
+		p.BytesPerSecond = float64(p.Bytes) / secs
+
+		// Estimate from the rate at which attachments have finished. Skipped
+		// attachments take no time, so they don't count.
+		if finished := p.Done + p.Failed; finished > 0 && p.Remaining > 0 {
+			p.ETA = time.Duration(float64(p.Remaining) * float64(p.Elapsed) / float64(finished))
+		}
+	}
+	return &p
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r     io.Reader
+	count *int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	atomic.AddInt64(cr.count, int64(n))
+	return n, err
+}
+
+// Progress returns a snapshot of d's progress.
+func (d *ImageDownloader) Progress() *Progress {
+	return d.progress.snapshot()
+}
+
+// ProgressReporter periodically reports an ImageDownloader's progress.
+type ProgressReporter struct {
+	Downloader *ImageDownloader
+	Interval   time.Duration
+
+	// Out, if not nil, receives a line of progress each Interval.
+	Out io.Writer
+	// StatusPath, if not empty, is replaced with the JSON-encoded Progress
+	// each Interval.
+	StatusPath string
+}
+
+// Run reports progress until ctx is cancelled, and then reports it once more.
+// Errors are logged, and do not stop reporting.
+func (pr *ProgressReporter) Run(ctx context.Context) {
+	t := time.NewTicker(pr.Interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			pr.logReport()
+			return
+		}
+		pr.logReport()
+	}
+}
+
+func (pr *ProgressReporter) logReport() {
+	if err := pr.Report(); err != nil {
+		log.Printf("WARNING: Could not report progress: %s", err)
+	}
+}
+
+// Report reports the current progress.
+func (pr *ProgressReporter) Report() error {
+	p := pr.Downloader.Progress()
+	if pr.Out != nil {
+		fmt.Fprintf(pr.Out, "Progress: %s\n", p)
+	}
+	if pr.StatusPath != "" {
+		if err := writeStatusFile(pr.StatusPath, p); err != nil {
+			return fmt.Errorf("could not write status file %s: %w", pr.StatusPath, err)
+		}
+	}
+	return nil
+}
+
+// writeStatusFile replaces path with p, so that readers never see a partial
+// file.
+func writeStatusFile(path string, p *Progress) error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "tmp-"+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,290 @@
+package parse
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-retryablehttp"
+)
+
+// maxRetryAfter bounds the delay that a server may request via Retry-After.
+const maxRetryAfter = 10 * time.Minute
+
+// tokenBucket limits the rate of requests to a single host.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // Tokens per second.
+	burst  float64
+	tokens float64
+	last   time.Time
+
+	// pausedUntil, if in the future, blocks all requests until then.
+	pausedUntil time.Time
+}
+
+// wait blocks until a request may be made, or ctx is cancelled.
+func (tb *tokenBucket) wait(ctx context.Context) error {
+	for {
+		delay := tb.reserve(time.Now())
+		if delay <= 0 {
+			return nil
+		}
+
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// reserve takes a token if one is available at now, returning zero. Otherwise,
+// it returns how long to wait before trying again.
+func (tb *tokenBucket) reserve(now time.Time) time.Duration {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	if now.Before(tb.pausedUntil) {
+		return tb.pausedUntil.Sub(now)
+	}
+	if tb.rate <= 0 {
+		return 0
+	}
+
+	if tb.last.IsZero() {
+		tb.tokens = tb.burst
+	} else {
+		tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+		if tb.tokens > tb.burst {
+			tb.tokens = tb.burst
+		}
+	}
+	tb.last = now
+
+	if tb.tokens >= 1 {
+		tb.tokens--
+		return 0
+	}
+	return time.Duration((1 - tb.tokens) / tb.rate * float64(time.Second))
+}
+
+// pauseUntil blocks requests until t.
+func (tb *tokenBucket) pauseUntil(t time.Time) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if t.After(tb.pausedUntil) {
+		tb.pausedUntil = t
+	}
+}
+
+// hostLimiter holds a tokenBucket for each host.
+type hostLimiter struct {
+	rate  float64
+	burst int
+
+	mu    sync.Mutex
+	hosts map[string]*tokenBucket
+}
+
+func (hl *hostLimiter) forHost(host string) *tokenBucket {
+	hl.mu.Lock()
+	defer hl.mu.Unlock()
+
+	tb := hl.hosts[host]
+	if tb == nil {
+		burst := float64(hl.burst)
+		if burst < 1 {
+			burst = 1
+		}
+		tb = &tokenBucket{rate: hl.rate, burst: burst}
+		if hl.hosts == nil {
+			hl.hosts = make(map[string]*tokenBucket)
+		}
+		hl.hosts[host] = tb
+	}
+	return tb
+}
+
+// concurrencyLimiter bounds the number of concurrent downloads. If adaptive,
+// the bound is halved when the server throttles us, and grows back by one
+// after a run of successful requests.
+type concurrencyLimiter struct {
+	max      int
+	adaptive bool
+
+	mu        sync.Mutex
+	limit     int
+	inUse     int
+	successes int
+	lastDrop  time.Time
+	// changed is closed, and replaced, whenever a slot may have become free.
+	changed chan struct{}
+}
+
+// concurrencyDropInterval is the minimum time between reductions, so that a
+// single wave of throttled responses only reduces concurrency once.
+const concurrencyDropInterval = 10 * time.Second
+
+func newConcurrencyLimiter(max int, adaptive bool) *concurrencyLimiter {
+	if max < 1 {
+		max = 1
+	}
+	return &concurrencyLimiter{
+		max:      max,
+		adaptive: adaptive,
+		limit:    max,
+		changed:  make(chan struct{}),
+	}
+}
+
+// acquire blocks until a slot is available, or ctx is cancelled.
+func (cl *concurrencyLimiter) acquire(ctx context.Context) error {
+	for {
+		cl.mu.Lock()
+		if cl.inUse < cl.limit {
+			cl.inUse++
+			cl.mu.Unlock()
+			return nil
+		}
+		changed := cl.changed
+		cl.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (cl *concurrencyLimiter) release() {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.inUse--
+	cl.notifyLocked()
+}
+
+func (cl *concurrencyLimiter) notifyLocked() {
+	close(cl.changed)
+	cl.changed = make(chan struct{})
+}
+
+// throttled records that a server throttled a request.
+func (cl *concurrencyLimiter) throttled() {
+	if !cl.adaptive {
+		return
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.successes = 0
+	if cl.limit == 1 || time.Since(cl.lastDrop) < concurrencyDropInterval {
+		return
+	}
+	cl.limit /= 2
+	cl.lastDrop = time.Now()
+	log.Printf("Server is throttling requests; reducing concurrency to %d.", cl.limit)
+}
+
+// succeeded records that a request succeeded.
+func (cl *concurrencyLimiter) succeeded() {
+	if !cl.adaptive {
+		return
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if cl.limit >= cl.max {
+		return
+	}
+	cl.successes++
+	if cl.successes >= 10*cl.limit {
+		cl.limit++
+		cl.successes = 0
+		log.Printf("Increasing concurrency to %d.", cl.limit)
+		cl.notifyLocked()
+	}
+}
+
+// throttledTransport applies per-host rate limits to requests, and reports
+// throttled responses.
+type throttledTransport struct {
+	base  http.RoundTripper
+	hosts *hostLimiter
+	conc  *concurrencyLimiter
+}
+
+func (tt *throttledTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return tt.base.RoundTrip(req)
+	}
+
+	tb := tt.hosts.forHost(req.URL.Host)
+	if err := tb.wait(req.Context()); err != nil {
+		return nil, err
+	}
+
+	resp, err := tt.base.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+
+	switch {
+	case isThrottled(resp):
+		tt.conc.throttled()
+		if d, ok := retryAfter(resp); ok {
+			log.Printf("Host %s asked us to wait %s.", req.URL.Host, d)
+			tb.pauseUntil(time.Now().Add(d))
+		}
+	case resp.StatusCode < 400:
+		tt.conc.succeeded()
+	}
+	return resp, nil
+}
+
+func isThrottled(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable
+}
+
+// retryAfter returns the delay requested by resp's Retry-After header, if any.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+
+	var d time.Duration
+	if secs, err := strconv.Atoi(v); err == nil {
+		d = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(v); err == nil {
+		d = time.Until(t)
+	} else {
+		return 0, false
+	}
+
+	switch {
+	case d < 0:
+		d = 0
+	case d > maxRetryAfter:
+		d = maxRetryAfter
+	}
+	return d, true
+}
+
+// retryAfterBackoff is like retryablehttp.DefaultBackoff, but waits as long as
+// a throttled response asks.
+func retryAfterBackoff(min, max time.Duration, attemptNum int, resp *http.Response) time.Duration {
+	backoff := retryablehttp.DefaultBackoff(min, max, attemptNum, resp)
+	if resp != nil && isThrottled(resp) {
+		if d, ok := retryAfter(resp); ok && d > backoff {
+			return d
+		}
+	}
+	return backoff
+}
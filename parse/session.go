@@ -0,0 +1,262 @@
+package parse
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// SessionExpired is returned when downloads are abandoned because the Google
+// session in the supplied cookies is no longer valid.
+var SessionExpired = errors.New("Google session expired; export fresh cookies and try again")
+
+// errSessionRenewed is returned when a request failed because the session
+// expired, but the session has since been renewed. The request should be
+// retried.
+var errSessionRenewed = errors.New("session renewed")
+
+// forbiddenLimit is the number of consecutive 403 responses, from any host,
+// that are taken to mean that the session has expired. Individual attachments
+// may be forbidden, so a single 403 is not enough.
+const forbiddenLimit = 5
+
+// loginPageMarkers are found in the HTML of Google's sign-in pages.
+var loginPageMarkers = [][]byte{
+	[]byte("accounts.google.com/ServiceLogin"),
+	[]byte("accounts.google.com/v3/signin"),
+	[]byte("accounts.google.com/signin"),
+	[]byte(`id="identifierId"`),
+}
+
+// session holds the cookies used for downloads, and coordinates pausing
+// downloads when they stop working.
+//
+// session implements http.CookieJar, so its cookies can be replaced while
+// requests are in flight.
+type session struct {
+	// reload, if not nil, is called to obtain fresh cookies when the session
+	// expires. Otherwise, downloads are abandoned.
+	reload func(ctx context.Context) ([]*http.Cookie, error)
+
+	mu       sync.Mutex
+	jar      http.CookieJar
+	unscoped []*http.Cookie
+
+	// generation is incremented each time the session is renewed.
+	generation int
+	// renewing, if not nil, is closed once a renewal attempt completes.
+	renewing chan struct{}
+	// err, if not nil, is the error that downloads were abandoned with.
+	err error
+	// forbidden is the number of consecutive 403 responses.
+	forbidden int
+}
+
+// setCookies replaces s's cookies. Cookies with a Domain are scoped to it;
+// cookies without one are sent to Google hosts (see isGoogleHost).
+func (s *session) setCookies(cookies []*http.Cookie) error {
+	jar, err := NewCookieJar(cookies)
+	if err != nil {
+		return err
+	}
+
+	var unscoped []*http.Cookie
+	for _, c := range cookies {
+		if c.Domain == "" {
+			unscoped = append(unscoped, c)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jar, s.unscoped = jar, unscoped
+	return nil
+}
+
+// SetCookies implements http.CookieJar.
+func (s *session) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	s.mu.Lock()
+	jar := s.jar
+	s.mu.Unlock()
+
+	if jar != nil {
+		jar.SetCookies(u, cookies)
+	}
+}
+
+// Cookies implements http.CookieJar.
+func (s *session) Cookies(u *url.URL) []*http.Cookie {
+	s.mu.Lock()
+	jar := s.jar
+	s.mu.Unlock()
+
+	if jar == nil {
+		return nil
+	}
+	return jar.Cookies(u)
+}
+
+// unscopedCookies returns the cookies without a Domain that are sent with a
+// request to u. These are only sent to Google hosts, so that the user's
+// session is not leaked to the hosts of link previews and other embeds.
+func (s *session) unscopedCookies(u *url.URL) []*http.Cookie {
+	if !isGoogleHost(u.Hostname()) {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.unscoped
+}
+
+// googleDomains are the domains, and their subdomains, that attachments are
+// downloaded from with the user's Google session.
+var googleDomains = []string{
+	"google.com",
+	"googleusercontent.com",
+}
+
+// isGoogleHost returns true if host is in one of googleDomains.
+func isGoogleHost(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, d := range googleDomains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// Err returns the error that downloads were abandoned with, if any.
+func (s *session) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// wait blocks while the session is being renewed. It returns the current
+// session generation, to be passed to expired.
+func (s *session) wait(ctx context.Context) (int, error) {
+	for {
+		s.mu.Lock()
+		gen, renewing, err := s.generation, s.renewing, s.err
+		s.mu.Unlock()
+
+		switch {
+		case err != nil:
+			return 0, err
+		case renewing == nil:
+			return gen, nil
+		}
+
+		select {
+		case <-renewing:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// checkResponse determines whether resp, received during session generation
+// gen, shows that the session has expired. If it has, checkResponse pauses
+// downloads until the session is renewed, and returns errSessionRenewed, or
+// the error that downloads were abandoned with.
+//
+// head is the start of the response body, if available.
+func (s *session) checkResponse(ctx context.Context, gen int, resp *http.Response, head []byte) error {
+	reason := s.authFailure(resp, head)
+	if reason == "" {
+		return nil
+	}
+	return s.expired(ctx, gen, reason)
+}
+
+// authFailure returns why resp indicates that the session is no longer
+// valid, or an empty string if it doesn't.
+func (s *session) authFailure(resp *http.Response, head []byte) string {
+	if u := resp.Request.URL; u.Scheme != "http" && u.Scheme != "https" {
+		return ""
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if resp.StatusCode != http.StatusForbidden {
+		s.forbidden = 0
+	}
+
+	switch {
+	case resp.Request.URL.Host == "accounts.google.com":
+		return fmt.Sprintf("redirected to sign-in page %s", resp.Request.URL)
+	case resp.StatusCode == http.StatusUnauthorized:
+		return fmt.Sprintf("got status %s", resp.Status)
+	case resp.StatusCode == http.StatusForbidden:
+		s.forbidden++
+		if s.forbidden >= forbiddenLimit {
+			s.forbidden = 0
+			return fmt.Sprintf("got %d consecutive %s responses", forbiddenLimit, resp.Status)
+		}
+	case getMediaType(resp) == "text/html":
+		for _, m := range loginPageMarkers {
+			if bytes.Contains(head, m) {
+				return "got sign-in page"
+			}
+		}
+	}
+	return ""
+}
+
+// expired reports that the session of generation gen has expired.
+//
+// The first caller to report an expired generation renews it, while others
+// wait. If renewal fails, all downloads are abandoned.
+func (s *session) expired(ctx context.Context, gen int, reason string) error {
+	s.mu.Lock()
+	if s.err != nil {
+		err := s.err
+		s.mu.Unlock()
+		return err
+	}
+	if gen != s.generation || s.renewing != nil {
+		// Someone else has renewed, or is renewing, the session.
+		s.mu.Unlock()
+		if _, err := s.wait(ctx); err != nil {
+			return err
+		}
+		return errSessionRenewed
+	}
+	s.renewing = make(chan struct{})
+	s.mu.Unlock()
+
+	log.Printf("WARNING: Google session appears to have expired (%s); pausing downloads.", reason)
+	err := SessionExpired
+	if s.reload != nil {
+		var cookies []*http.Cookie
+		if cookies, err = s.reload(ctx); err == nil {
+			err = s.setCookies(cookies)
+		}
+		if err != nil {
+			err = fmt.Errorf("%w: could not reload cookies: %s", SessionExpired, err)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		log.Printf("ERROR: Abandoning downloads: %s", err)
+		s.err = err
+	} else {
+		log.Printf("Reloaded cookies; resuming downloads.")
+		s.generation++
+		err = errSessionRenewed
+	}
+	close(s.renewing)
+	s.renewing = nil
+	return err
+}
@@ -0,0 +1,404 @@
+package parse
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+)
+
+// StopIteration can be returned by an iteration callback to end iteration
+// early without an error.
+var StopIteration = errors.New("stop iteration")
+
+// EventSource is a single conversation whose events can be visited in order.
+//
+// It is implemented by both the fully-loaded Conversation and the incremental
+// StreamConversation, so consumers can operate on either.
+type EventSource interface {
+	Info() *ConversationInfo
+	ParticipantRegistry() *ParticipantRegistry
+	ForEachEvent(fn func(i int, e *Event) error) error
+}
+
+var _ EventSource = (*Conversation)(nil)
+var _ EventSource = (*StreamConversation)(nil)
+
+// Stream decodes a Hangouts JSON document incrementally, one conversation at a
+// time. Unlike Root, it never holds more than a single event in memory.
+//
+// Conversations are returned by Next. A returned conversation is only valid
+// until the next call to Next.
+type Stream struct {
+	dec *json.Decoder
+
+	started bool
+	done    bool
+	current *StreamConversation
+}
+
+// NewStream returns a Stream that reads a Hangouts JSON document from r.
+func NewStream(r io.Reader) *Stream {
+	return &Stream{dec: json.NewDecoder(r)}
+}
+
+// Next returns the next conversation in the document. It returns io.EOF when
+// no conversations remain.
+func (s *Stream) Next() (*StreamConversation, error) {
+	if s.current != nil {
+		if err := s.current.finish(); err != nil {
+			return nil, err
+		}
+		s.current = nil
+	}
+	if s.done {
+		return nil, io.EOF
+	}
+
+	if !s.started {
+		found, err := s.seekConversations()
+		if err != nil {
+			return nil, err
+		}
+		s.started = true
+		if !found {
+			s.done = true
+			return nil, io.EOF
+		}
+	}
+
+	if !s.dec.More() {
+		// End of the "conversations" array; consume the rest of the document.
+		s.done = true
+		if err := expectDelim(s.dec, ']'); err != nil {
+			return nil, err
+		}
+		if err := skipObjectRemainder(s.dec); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+
+	sc := &StreamConversation{s: s}
+	if err := sc.open(); err != nil {
+		return nil, err
+	}
+	s.current = sc
+	return sc, nil
+}
+
+// seekConversations advances the decoder to the first element of the
+// "conversations" array. It returns false if the document has no such array.
+func (s *Stream) seekConversations() (bool, error) {
+	if err := expectDelim(s.dec, '{'); err != nil {
+		return false, err
+	}
+	for s.dec.More() {
+		key, err := readKey(s.dec)
+		if err != nil {
+			return false, err
+		}
+		if key != "conversations" {
+			if err := skipValue(s.dec); err != nil {
+				return false, err
+			}
+			continue
+		}
+
+		if err := expectDelim(s.dec, '['); err != nil {
+			return false, fmt.Errorf("conversations: %w", err)
+		}
+		return true, nil
+	}
+	return false, expectDelim(s.dec, '}')
+}
+
+// ForEachConversation streams the Hangouts JSON document in r, invoking fn for
+// each conversation in turn.
+//
+// If fn returns StopIteration, iteration ends and ForEachConversation returns
+// nil.
+func ForEachConversation(r io.Reader, fn func(sc *StreamConversation) error) error {
+	s := NewStream(r)
+	for {
+		sc, err := s.Next()
+		switch err {
+		case nil:
+		case io.EOF:
+			return nil
+		default:
+			return err
+		}
+
+		switch err := fn(sc); err {
+		case nil:
+		case StopIteration:
+			return nil
+		default:
+			return err
+		}
+	}
+}
+
+// StreamConversation is a conversation being read from a Stream.
+//
+// Its metadata is decoded eagerly, while its events are decoded one at a time
+// by ForEachEvent. Events can only be visited once.
+type StreamConversation struct {
+	s *Stream
+
+	entry *ConversationEntry
+	reg   ParticipantRegistry
+
+	// pendingEvents is true if the decoder is positioned at the (unread)
+	// "events" value.
+	pendingEvents bool
+	// inEvents is true if the decoder is positioned inside of the "events"
+	// array.
+	inEvents bool
+	consumed bool
+	closed   bool
+
+	// bufferedEvents holds events that appeared before the conversation
+	// metadata, and so had to be read before the conversation was returned.
+	bufferedEvents []json.RawMessage
+}
+
+func (sc *StreamConversation) open() error {
+	dec := sc.s.dec
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+
+	for dec.More() {
+		key, err := readKey(dec)
+		if err != nil {
+			return err
+		}
+
+		switch key {
+		case "conversation":
+			var ce ConversationEntry
+			if err := dec.Decode(&ce); err != nil {
+				return fmt.Errorf("could not decode conversation: %w", err)
+			}
+			sc.entry = &ce
+
+		case "events":
+			if sc.entry != nil {
+				// Leave the events in the stream for ForEachEvent.
+				sc.pendingEvents = true
+				sc.registerParticipants()
+				return nil
+			}
+
+			// We don't know what conversation this is yet, so we have to buffer.
+			if err := dec.Decode(&sc.bufferedEvents); err != nil {
+				return fmt.Errorf("could not decode events: %w", err)
+			}
+
+		default:
+			if err := skipValue(dec); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := expectDelim(dec, '}'); err != nil {
+		return err
+	}
+	sc.closed = true
+	sc.registerParticipants()
+	return nil
+}
+
+func (sc *StreamConversation) registerParticipants() {
+	if info := sc.Info(); info != nil {
+		for _, pd := range info.ParticipantData {
+			sc.reg.Register(pd)
+		}
+	}
+}
+
+// finish advances the underlying decoder past the end of this conversation.
+func (sc *StreamConversation) finish() error {
+	if sc.closed {
+		return nil
+	}
+	dec := sc.s.dec
+
+	switch {
+	case sc.pendingEvents:
+		if err := skipValue(dec); err != nil {
+			return err
+		}
+		sc.pendingEvents = false
+
+	case sc.inEvents:
+		for dec.More() {
+			if err := skipValue(dec); err != nil {
+				return err
+			}
+		}
+		if err := expectDelim(dec, ']'); err != nil {
+			return err
+		}
+		sc.inEvents = false
+	}
+
+	if err := skipObjectRemainder(dec); err != nil {
+		return err
+	}
+	sc.closed = true
+	return nil
+}
+
+// Info returns the conversation's metadata, or nil if it has none.
+func (sc *StreamConversation) Info() *ConversationInfo {
+	if sc.entry == nil {
+		return nil
+	}
+	return sc.entry.ConversationInfo
+}
+
+func (sc *StreamConversation) ParticipantRegistry() *ParticipantRegistry { return &sc.reg }
+
+// ForEachEvent decodes each of the conversation's events in turn and invokes fn
+// with it. Events that can't be decoded are logged and skipped.
+//
+// If fn returns StopIteration, iteration ends and ForEachEvent returns nil. The
+// remaining events are skipped and cannot be visited again.
+func (sc *StreamConversation) ForEachEvent(fn func(i int, e *Event) error) error {
+	if sc.consumed {
+		return errors.New("events have already been consumed")
+	}
+	sc.consumed = true
+
+	if sc.bufferedEvents != nil {
+		events := sc.bufferedEvents
+		sc.bufferedEvents = nil
+		for i, raw := range events {
+			event := decodeEvent(i, raw)
+			if event == nil {
+				continue
+			}
+			switch err := fn(i, event); err {
+			case nil:
+			case StopIteration:
+				return nil
+			default:
+				return err
+			}
+		}
+		return nil
+	}
+
+	if !sc.pendingEvents {
+		// This conversation has no events.
+		return nil
+	}
+
+	dec := sc.s.dec
+	if err := expectDelim(dec, '['); err != nil {
+		return fmt.Errorf("events: %w", err)
+	}
+	sc.pendingEvents = false
+	sc.inEvents = true
+
+	for i := 0; dec.More(); i++ {
+		// Read the event whole, so that one that can't be decoded can be
+		// skipped.
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return fmt.Errorf("could not read event #%d: %w", i, err)
+		}
+		event := decodeEvent(i, raw)
+		if event == nil {
+			continue
+		}
+		switch err := fn(i, event); err {
+		case nil:
+		case StopIteration:
+			return nil
+		default:
+			return err
+		}
+	}
+
+	if err := expectDelim(dec, ']'); err != nil {
+		return err
+	}
+	sc.inEvents = false
+	return nil
+}
+
+// decodeEvent decodes event #i from raw. If it can't be decoded, it is logged,
+// and decodeEvent returns nil; one bad event shouldn't end the whole run.
+func decodeEvent(i int, raw json.RawMessage) *Event {
+	var event Event
+	if err := json.Unmarshal(raw, &event); err != nil {
+		log.Printf("Event #%d could not be processed: %s", i, err)
+		return nil
+	}
+	return &event
+}
+
+func expectDelim(dec *json.Decoder, d json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if v, ok := tok.(json.Delim); !ok || v != d {
+		return fmt.Errorf("expected %q, got %v", d, tok)
+	}
+	return nil
+}
+
+func readKey(dec *json.Decoder) (string, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return "", err
+	}
+	key, ok := tok.(string)
+	if !ok {
+		return "", fmt.Errorf("expected object key, got %v", tok)
+	}
+	return key, nil
+}
+
+// skipValue advances dec past the next value without retaining it.
+func skipValue(dec *json.Decoder) error {
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if d, ok := tok.(json.Delim); ok {
+			switch d {
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+			}
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+// skipObjectRemainder advances dec past any remaining keys in the current
+// object, and past the object's closing delimiter.
+func skipObjectRemainder(dec *json.Decoder) error {
+	for dec.More() {
+		if _, err := readKey(dec); err != nil {
+			return err
+		}
+		if err := skipValue(dec); err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, '}')
+}
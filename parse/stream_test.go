@@ -0,0 +1,184 @@
+package parse
+
+import (
+	"strings"
+	"testing"
+)
+
+// streamEvents streams the Hangouts JSON document doc, and returns each
+// conversation's ID followed by the timestamps of its events.
+func streamEvents(t *testing.T, doc string) []string {
+	t.Helper()
+
+	var got []string
+	err := ForEachConversation(strings.NewReader(doc), func(sc *StreamConversation) error {
+		id := "<none>"
+		if info := sc.Info(); info != nil {
+			id = info.ID.ID
+		}
+		got = append(got, id)
+		return sc.ForEachEvent(func(i int, e *Event) error {
+			got = append(got, e.Timestamp)
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatalf("could not stream: %s", err)
+	}
+	return got
+}
+
+func TestStream(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name string
+		doc  string
+		want []string
+	}{
+		{
+			name: "empty",
+			doc:  `{}`,
+			want: nil,
+		},
+		{
+			name: "no conversations",
+			doc:  `{"conversations":[]}`,
+			want: nil,
+		},
+		{
+			name: "conversations",
+			doc: `{"conversations":[
+				{"conversation":{"conversation":{"id":{"id":"c1"}}},"events":[{"timestamp":"1"},{"timestamp":"2"}]},
+				{"conversation":{"conversation":{"id":{"id":"c2"}}},"events":[]},
+				{"conversation":{"conversation":{"id":{"id":"c3"}}}}
+			]}`,
+			want: []string{"c1", "1", "2", "c2", "c3"},
+		},
+		{
+			name: "events before metadata",
+			doc: `{"conversations":[
+				{"events":[{"timestamp":"1"}],"conversation":{"conversation":{"id":{"id":"c1"}}}},
+				{"conversation":{"conversation":{"id":{"id":"c2"}}},"events":[{"timestamp":"2"}]}
+			]}`,
+			want: []string{"c1", "1", "c2", "2"},
+		},
+		{
+			name: "other keys",
+			doc: `{"before":{"x":[1,2]},"conversations":[
+				{"extra":[{}],"conversation":{"conversation":{"id":{"id":"c1"}}},"events":[{"timestamp":"1"}],"more":"x"}
+			],"after":true}`,
+			want: []string{"c1", "1"},
+		},
+		{
+			name: "bad event is skipped",
+			doc: `{"conversations":[
+				{"conversation":{"conversation":{"id":{"id":"c1"}}},"events":[{"timestamp":"1"},{"timestamp":2},{"timestamp":"3"}]},
+				{"events":[{"timestamp":{}},{"timestamp":"4"}],"conversation":{"conversation":{"id":{"id":"c2"}}}}
+			]}`,
+			want: []string{"c1", "1", "3", "c2", "4"},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			got := streamEvents(t, tc.doc)
+			if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestStreamUnvisitedEvents(t *testing.T) {
+	t.Parallel()
+
+	// Events that aren't visited, or are only partly visited, are skipped.
+	doc := `{"conversations":[
+		{"conversation":{"conversation":{"id":{"id":"c1"}}},"events":[{"timestamp":"1"},{"timestamp":"2"}]},
+		{"conversation":{"conversation":{"id":{"id":"c2"}}},"events":[{"timestamp":"3"},{"timestamp":"4"}]},
+		{"conversation":{"conversation":{"id":{"id":"c3"}}},"events":[{"timestamp":"5"}]}
+	]}`
+	var got []string
+	err := ForEachConversation(strings.NewReader(doc), func(sc *StreamConversation) error {
+		id := sc.Info().ID.ID
+		got = append(got, id)
+		if id == "c1" {
+			return nil
+		}
+		return sc.ForEachEvent(func(i int, e *Event) error {
+			got = append(got, e.Timestamp)
+			return StopIteration
+		})
+	})
+	if err != nil {
+		t.Fatalf("could not stream: %s", err)
+	}
+	if want := "c1,c2,3,c3,5"; strings.Join(got, ",") != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestStreamEventsVisitedOnce(t *testing.T) {
+	t.Parallel()
+
+	doc := `{"conversations":[{"conversation":{"conversation":{"id":{"id":"c1"}}},"events":[{"timestamp":"1"}]}]}`
+	err := ForEachConversation(strings.NewReader(doc), func(sc *StreamConversation) error {
+		visit := func(i int, e *Event) error { return nil }
+		if err := sc.ForEachEvent(visit); err != nil {
+			t.Fatalf("first visit failed: %s", err)
+		}
+		if err := sc.ForEachEvent(visit); err == nil {
+			t.Error("second visit succeeded, want error")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("could not stream: %s", err)
+	}
+}
+
+func TestStreamMalformed(t *testing.T) {
+	t.Parallel()
+
+	for _, doc := range []string{
+		`[]`,
+		`{"conversations":{}}`,
+		`{"conversations":[{"conversation":{"conversation":{"id":{"id":"c1"}}},"events":[{"timestamp":"1"},]}]}`,
+		`{"conversations":[{"conversation":{"conversation":{"id":{"id":"c1"}}},"events":[{"timestamp":"1"}`,
+	} {
+		err := ForEachConversation(strings.NewReader(doc), func(sc *StreamConversation) error {
+			return sc.ForEachEvent(func(i int, e *Event) error { return nil })
+		})
+		if err == nil {
+			t.Errorf("streaming %s succeeded, want error", doc)
+		}
+	}
+}
+
+func TestConversationSkipsBadEvents(t *testing.T) {
+	t.Parallel()
+
+	var r Root
+	doc := `{"conversations":[{"conversation":{"conversation":{"id":{"id":"c1"}}},"events":[{"timestamp":"1"},{"timestamp":2},{"timestamp":"3"}]}]}`
+	if err := r.Decode(strings.NewReader(doc)); err != nil {
+		t.Fatalf("could not decode: %s", err)
+	}
+	c, err := r.GetConversation("c1")
+	if err != nil {
+		t.Fatalf("could not get conversation: %s", err)
+	}
+
+	var got []string
+	err = c.ForEachEvent(func(i int, e *Event) error {
+		got = append(got, e.Timestamp)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("could not visit events: %s", err)
+	}
+	if want := "1,3"; strings.Join(got, ",") != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
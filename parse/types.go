@@ -5,6 +5,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log"
+	"net/url"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -15,9 +18,18 @@ import (
 type EventType string
 
 const (
-	EventTypeRenameConversation EventType = "RENAME_CONVERSATION"
-	EventTypeAddUser                      = "ADD_USER"
-	EventTypeRegularChatMessage           = "REGULAR_CHAT_MESSAGE"
+	EventTypeRenameConversation           EventType = "RENAME_CONVERSATION"
+	EventTypeAddUser                                = "ADD_USER"
+	EventTypeRemoveUser                             = "REMOVE_USER"
+	EventTypeRegularChatMessage                     = "REGULAR_CHAT_MESSAGE"
+	EventTypeHangoutEvent                           = "HANGOUT_EVENT"
+	EventTypeOTRModification                        = "OTR_MODIFICATION"
+	EventTypeGroupLinkSharingModification           = "GROUP_LINK_SHARING_MODIFICATION"
+)
+
+const (
+	ConversationTypeOneToOne = "STICKY_ONE_TO_ONE"
+	ConversationTypeGroup    = "GROUP"
 )
 
 type EmbedItemType string
@@ -27,6 +39,10 @@ const (
 	EmbedItemPlaceV2                 = "PLACE_V2"
 	EmbedItemThingV2                 = "THING_V2"
 	EmbedItemThing                   = "THING"
+
+	// EmbedItemLocalFile is not a Hangouts type. It is used for attachments
+	// whose content is available on local disk, as in Google Chat exports.
+	EmbedItemLocalFile = "LOCAL_FILE"
 )
 
 type ParticipantRegistry struct {
@@ -99,6 +115,14 @@ func (ce *Conversation) initialize() error {
 
 func (ce *Conversation) ParticipantRegistry() *ParticipantRegistry { return &ce.reg }
 
+// Info returns the conversation's metadata, or nil if it has none.
+func (ce *Conversation) Info() *ConversationInfo {
+	if ce.Conversation == nil {
+		return nil
+	}
+	return ce.Conversation.ConversationInfo
+}
+
 func (ce *Conversation) EventsSize() int {
 	return len(ce.events)
 }
@@ -113,6 +137,28 @@ func (ce *Conversation) ResolveAll() error {
 	return nil
 }
 
+// ForEachEvent invokes fn for each event in the conversation, in order. Events
+// that can't be decoded are logged and skipped.
+//
+// If fn returns StopIteration, iteration ends and ForEachEvent returns nil.
+func (ce *Conversation) ForEachEvent(fn func(i int, e *Event) error) error {
+	for i := 0; i < len(ce.events); i++ {
+		e, err := ce.Event(i)
+		if err != nil {
+			log.Printf("Event #%d could not be processed: %s", i, err)
+			continue
+		}
+		switch err := fn(i, e); err {
+		case nil:
+		case StopIteration:
+			return nil
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
 func (ce *Conversation) Event(i int) (*Event, error) {
 	if i < 0 || i >= len(ce.events) {
 		return nil, errors.New("Index out of bounds")
@@ -135,6 +181,14 @@ type SingleID struct {
 	ID string `json:"id"`
 }
 
+// String returns the ID value. It is safe to call on a nil SingleID.
+func (id *SingleID) String() string {
+	if id == nil {
+		return ""
+	}
+	return id.ID
+}
+
 type ConversationInfo struct {
 	ID                 *SingleID          `json:"id"`
 	Type               string             `json:"type"`
@@ -175,6 +229,12 @@ func (pd *ParticipantData) DisplayName() string {
 	return pd.FallbackName
 }
 
+const (
+	SegmentTypeText      = "TEXT"
+	SegmentTypeLink      = "LINK"
+	SegmentTypeLineBreak = "LINE_BREAK"
+)
+
 type MessageContentSegment struct {
 	Type       string `json:"type"`
 	Text       string `json:"text"`
@@ -252,6 +312,27 @@ type ThingV2 struct {
 	RepresentativeImage *RepresentativeImage `json:"representative_image"`
 }
 
+// LocalFile is an attachment whose content is stored on local disk.
+type LocalFile struct {
+	// Path is the path of the file.
+	Path string `json:"path"`
+	// Name is the original name of the file, if known.
+	Name string `json:"name,omitempty"`
+}
+
+// URL returns a "file://" URL for the local file.
+func (lf *LocalFile) URL() string {
+	path := lf.Path
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	u := url.URL{
+		Scheme: "file",
+		Path:   filepath.ToSlash(path),
+	}
+	return u.String()
+}
+
 type EmbedItem struct {
 	Type          []EmbedItemType `json:"type"`
 	ID            string          `json:"id"`
@@ -259,6 +340,7 @@ type EmbedItem struct {
 	PlaceV2       *PlaceV2        `json:"place_v2"`
 	ThingV2       *ThingV2        `json:"thing_v2"`
 	ImageObjectV2 *ImageObjectV2  `json:"image_object_v2"`
+	LocalFile     *LocalFile      `json:"local_file,omitempty"`
 }
 
 func (ei *EmbedItem) Key() string {
@@ -269,6 +351,15 @@ func (ei *EmbedItem) Key() string {
 		// Use a hash of the Thing's URL.
 		return util.HashForKey(p.URL)
 	}
+	if ei.ID == "" {
+		// Fall back to a hash of the Place's or image's URL.
+		if p := ei.PlaceV2; p != nil && p.URL != "" {
+			return util.HashForKey(p.URL)
+		}
+		if io := ei.ImageObjectV2; io != nil && io.URL != "" {
+			return util.HashForKey(io.URL)
+		}
+	}
 	return ei.ID
 }
 
@@ -291,12 +382,74 @@ type ConversationRename struct {
 	OldName string `json:"old_name"`
 }
 
+const (
+	MembershipChangeJoin  = "JOIN"
+	MembershipChangeLeave = "LEAVE"
+)
+
 type MembershipChange struct {
 	Type          string           `json:"type"`
 	ParticipantID []*ParticipantID `json:"participant_id"`
 	LeaveReason   string           `json:"leave_reason"`
 }
 
+const (
+	HangoutEventStart = "START_HANGOUT"
+	HangoutEventEnd   = "END_HANGOUT"
+)
+
+const (
+	HangoutMediaAudioVideo = "AUDIO_VIDEO"
+	HangoutMediaAudioOnly  = "AUDIO_ONLY"
+)
+
+// HangoutEvent is the start or end of a voice or video call.
+type HangoutEvent struct {
+	EventType     string           `json:"event_type"`
+	ParticipantID []*ParticipantID `json:"participant_id"`
+	MediaType     string           `json:"media_type"`
+
+	// HangoutDurationSecs is the length of the call, in seconds. It is only set
+	// on END_HANGOUT events.
+	HangoutDurationSecs string `json:"hangout_duration_secs"`
+}
+
+// Duration returns the length of the call, or zero if it is not known.
+func (he *HangoutEvent) Duration() (time.Duration, error) {
+	if he.HangoutDurationSecs == "" {
+		return 0, nil
+	}
+	secs, err := strconv.ParseInt(he.HangoutDurationSecs, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(secs) * time.Second, nil
+}
+
+const (
+	OTRStatusOnTheRecord  = "ON_THE_RECORD"
+	OTRStatusOffTheRecord = "OFF_THE_RECORD"
+)
+
+// OTRModification is a change to whether a conversation's history is kept.
+type OTRModification struct {
+	OldOTRStatus string `json:"old_otr_status"`
+	NewOTRStatus string `json:"new_otr_status"`
+	OldOTRToggle string `json:"old_otr_toggle"`
+	NewOTRToggle string `json:"new_otr_toggle"`
+}
+
+const (
+	LinkSharingOn  = "LINK_SHARING_ON"
+	LinkSharingOff = "LINK_SHARING_OFF"
+)
+
+// GroupLinkSharingModification is a change to whether a group conversation can
+// be joined by link.
+type GroupLinkSharingModification struct {
+	NewStatus string `json:"new_status"`
+}
+
 type Event struct {
 	ConversationID *SingleID      `json:"conversation_id"`
 	SenderID       *ParticipantID `json:"sender_id"`
@@ -306,6 +459,10 @@ type Event struct {
 	ChatMessage        *ChatMessage        `json:"chat_message"`
 	MembershipChange   *MembershipChange   `json:"membership_change"`
 
+	HangoutEvent                 *HangoutEvent                 `json:"hangout_event"`
+	OTRModification              *OTRModification              `json:"otr_modification"`
+	GroupLinkSharingModification *GroupLinkSharingModification `json:"group_link_sharing_modification"`
+
 	EventID   string    `json:"event_id"`
 	EventType EventType `json:"event_type"`
 }
@@ -345,6 +502,27 @@ func (e *Event) Description(reg *ParticipantRegistry) (string, error) {
 	if r := e.ConversationRename; r != nil {
 		parts = append(parts, fmt.Sprintf("Rename from %q to %q", r.OldName, r.NewName))
 	}
+	if r := e.MembershipChange; r != nil {
+		parts = append(parts, fmt.Sprintf("Membership %s: %s", r.Type, participantNames(reg, r.ParticipantID)))
+	}
+	if r := e.HangoutEvent; r != nil {
+		desc := fmt.Sprintf("Call %s (%s)", r.EventType, r.MediaType)
+		if d, err := r.Duration(); err != nil {
+			desc += fmt.Sprintf(", Duration Error (%s)", r.HangoutDurationSecs)
+		} else if d > 0 {
+			desc += fmt.Sprintf(", lasted %s", d)
+		}
+		if len(r.ParticipantID) > 0 {
+			desc += ": " + participantNames(reg, r.ParticipantID)
+		}
+		parts = append(parts, desc)
+	}
+	if r := e.OTRModification; r != nil {
+		parts = append(parts, fmt.Sprintf("History from %s to %s", r.OldOTRStatus, r.NewOTRStatus))
+	}
+	if r := e.GroupLinkSharingModification; r != nil {
+		parts = append(parts, fmt.Sprintf("Link sharing %s", r.NewStatus))
+	}
 	if r := e.ChatMessage; r != nil {
 		if mc := r.MessageContent; mc != nil {
 			for _, s := range mc.Segment {
@@ -356,6 +534,23 @@ func (e *Event) Description(reg *ParticipantRegistry) (string, error) {
 	return strings.Join(parts, "\n"), nil
 }
 
+// participantNames returns a comma-separated list of the names of ids.
+func participantNames(reg *ParticipantRegistry, ids []*ParticipantID) string {
+	names := make([]string, len(ids))
+	for i, id := range ids {
+		var pd *ParticipantData
+		if reg != nil {
+			pd = reg.ForID(id)
+		}
+		if pd != nil {
+			names[i] = pd.DisplayName()
+		} else {
+			names[i] = fmt.Sprintf("UNKNOWN(%s)", id)
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
 func (e *Event) AllWords() []string {
 	var words []string
 	if r := e.ChatMessage; r != nil {
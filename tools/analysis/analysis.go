@@ -3,14 +3,20 @@ package analysis
 import (
 	"bufio"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
 	"regexp"
 	"sort"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/danjacques/hangouts-migrate/attachment"
 	"github.com/danjacques/hangouts-migrate/import/mattermost"
@@ -54,20 +60,113 @@ func withBufferedWriter(path string, fn func(io.Writer) error) error {
 	return nil
 }
 
-func loadRoot(path string) (*parse.Root, error) {
-	var root parse.Root
-	err := withBufferedReader(path, func(r io.Reader) error {
-		log.Println("Loading root document...")
-		if err := root.Decode(r); err != nil {
+// forEachConversation streams the Hangouts JSON file at path, invoking fn for
+// each conversation in turn. Only one conversation is held in memory at a time.
+//
+// If path is a directory, it is read as a Google Chat Takeout export instead.
+func forEachConversation(path string, fn func(c parse.EventSource) error) error {
+	if parse.IsGoogleChatExport(path) {
+		log.Println("Reading Google Chat export...")
+		return parse.ForEachGoogleChatGroup(path, func(g *parse.GoogleChatGroup) error {
+			return fn(g)
+		})
+	}
+
+	return withBufferedReader(path, func(r io.Reader) error {
+		log.Println("Streaming root document...")
+		err := parse.ForEachConversation(r, func(sc *parse.StreamConversation) error {
+			return fn(sc)
+		})
+		if err != nil {
+			return err
+		}
+		log.Println("Finished streaming root document!")
+		return nil
+	})
+}
+
+// conversationSelector selects conversations by ID, by name, or all of them.
+type conversationSelector struct {
+	id         string
+	all        bool
+	nameRegexp string
+
+	re *regexp.Regexp
+}
+
+func (sel *conversationSelector) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&sel.id, "conversation", "", "Conversation ID to select.")
+	f.BoolVar(&sel.all, "all", false, "Select all conversations.")
+	f.StringVar(&sel.nameRegexp, "conversation_name_regexp", "",
+		"Select all conversations whose names match this regular expression.")
+}
+
+// validate checks that exactly one selection mode was supplied.
+func (sel *conversationSelector) validate() error {
+	modes := 0
+	if sel.id != "" {
+		modes++
+	}
+	if sel.all {
+		modes++
+	}
+	if sel.nameRegexp != "" {
+		re, err := regexp.Compile(sel.nameRegexp)
+		if err != nil {
+			return fmt.Errorf("invalid conversation name regexp: %w", err)
+		}
+		sel.re = re
+		modes++
+	}
+
+	if modes != 1 {
+		return errors.New("you must supply exactly one of -conversation, -all, or -conversation_name_regexp")
+	}
+	return nil
+}
+
+// single returns true if sel selects at most one conversation.
+func (sel *conversationSelector) single() bool { return sel.id != "" }
+
+func (sel *conversationSelector) matches(c parse.EventSource) bool {
+	info := c.Info()
+	switch {
+	case info == nil:
+		return false
+	case sel.id != "":
+		return info.ID.String() == sel.id
+	case sel.re != nil:
+		return sel.re.MatchString(info.Name)
+	default:
+		return sel.all
+	}
+}
+
+// forEachSelected streams the conversations at path, invoking fn for each
+// conversation selected by sel. It returns an error if no conversations were
+// selected.
+func forEachSelected(path string, sel *conversationSelector, fn func(c parse.EventSource) error) error {
+	found := false
+	err := forEachConversation(path, func(c parse.EventSource) error {
+		if !sel.matches(c) {
+			return nil
+		}
+		found = true
+		if err := fn(c); err != nil {
 			return err
 		}
-		log.Println("Successfully loaded root document!")
+		if sel.single() {
+			return parse.StopIteration
+		}
 		return nil
 	})
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if !found {
+		return errors.New("no matching conversations")
 	}
-	return &root, nil
+	return nil
 }
 
 func loadUserMapJSON(path string) (*mattermost.FixedUserMapper, *mattermost.ReactionInjector, error) {
@@ -96,20 +195,22 @@ func (cmd *listChatsCommand) Usage() string {
 }
 
 func (cmd *listChatsCommand) SetFlags(f *flag.FlagSet) {
-	f.StringVar(&cmd.path, "path", "", "Path to the Hangouts JSON file.")
+	f.StringVar(&cmd.path, "path", "", "Path to the Hangouts JSON file or Google Chat export directory.")
 }
 
 func (cmd *listChatsCommand) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
-	r, err := loadRoot(cmd.path)
+	var names []string
+	err := forEachConversation(cmd.path, func(c parse.EventSource) error {
+		if info := c.Info(); info != nil {
+			names = append(names, fmt.Sprintf("%s: %s", info.Name, info.ID))
+		}
+		return nil
+	})
 	if err != nil {
 		log.Printf("ERROR: Failed to load root file: %s", err)
 		return subcommands.ExitFailure
 	}
 
-	names := make([]string, len(r.GetConversationMap()))
-	for k, v := range r.GetConversationMap() {
-		names = append(names, fmt.Sprintf("%s: %s", k, v))
-	}
 	sort.Strings(names)
 	for _, name := range names {
 		log.Print(name)
@@ -118,55 +219,49 @@ func (cmd *listChatsCommand) Execute(_ context.Context, f *flag.FlagSet, _ ...in
 }
 
 type dumpChatCommand struct {
-	path           string
-	conversationID string
+	path string
+	sel  conversationSelector
 }
 
 func (cmd *dumpChatCommand) Name() string     { return "dump-chat" }
 func (cmd *dumpChatCommand) Synopsis() string { return "Dumps the text output of a chat." }
 func (cmd *dumpChatCommand) Usage() string {
-	return `dump-chat -path /path/to/JSON.json -conversation ID
-	Dump the contents of conversation <ID>.
+	return `dump-chat -path /path/to/JSON.json [-conversation ID | -all | -conversation_name_regexp RE]
+	Dump the contents of the selected conversations.
 	`
 }
 
 func (cmd *dumpChatCommand) SetFlags(f *flag.FlagSet) {
-	f.StringVar(&cmd.path, "path", "", "Path to the Hangouts JSON file.")
-	f.StringVar(&cmd.conversationID, "conversation", "", "Conversation ID to dump.")
+	f.StringVar(&cmd.path, "path", "", "Path to the Hangouts JSON file or Google Chat export directory.")
+	cmd.sel.SetFlags(f)
 }
 
 func (cmd *dumpChatCommand) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
-	if cmd.conversationID == "" {
-		log.Printf("ERROR: you must supply a conversation ID (-conversation).")
-		return subcommands.ExitFailure
-	}
-
-	r, err := loadRoot(cmd.path)
-	if err != nil {
-		log.Printf("ERROR: Failed to load root file: %s", err)
-		return subcommands.ExitFailure
-	}
-
-	c, err := r.GetConversation(cmd.conversationID)
-	if err != nil {
-		log.Printf("Could not get conversation %q: %s", cmd.conversationID, err)
+	if err := cmd.sel.validate(); err != nil {
+		log.Printf("ERROR: %s", err)
 		return subcommands.ExitFailure
 	}
 
-	for i := 0; i < c.EventsSize(); i++ {
-		e, err := c.Event(i)
-		if err != nil {
-			log.Printf("Event #%d could not be processed: %s", i, err)
-			continue
+	err := forEachSelected(cmd.path, &cmd.sel, func(c parse.EventSource) error {
+		if !cmd.sel.single() {
+			info := c.Info()
+			fmt.Printf("Conversation %s (%s)\n\n", info.ID, info.Name)
 		}
 
-		s, err := e.Description(c.ParticipantRegistry())
-		if err != nil {
-			log.Printf("Event #%d could not be described: %s", i, err)
-			continue
-		}
+		return c.ForEachEvent(func(i int, e *parse.Event) error {
+			s, err := e.Description(c.ParticipantRegistry())
+			if err != nil {
+				log.Printf("Event #%d could not be described: %s", i, err)
+				return nil
+			}
 
-		fmt.Printf("Event #%d\n%s\n\n", i, s)
+			fmt.Printf("Event #%d\n%s\n\n", i, s)
+			return nil
+		})
+	})
+	if err != nil {
+		log.Printf("Could not dump conversations: %s", err)
+		return subcommands.ExitFailure
 	}
 
 	log.Println("Finished!")
@@ -176,11 +271,24 @@ func (cmd *dumpChatCommand) Execute(_ context.Context, f *flag.FlagSet, _ ...int
 type donwloadAttachmentsCommand struct {
 	path           string
 	out            string
-	conversationID string
+	sel            conversationSelector
 	attachmentPath string
+	dbPath         string
 
-	cookiePath string
-	overwrite  bool
+	cookiePath    string
+	cookieFormat  string
+	reloadCookies bool
+	overwrite     bool
+	retryFailed   bool
+	maxAttempts   int
+
+	concurrency         int
+	hostRate            float64
+	hostBurst           int
+	adaptiveConcurrency bool
+
+	progressInterval time.Duration
+	statusPath       string
 }
 
 func (cmd *donwloadAttachmentsCommand) Name() string { return "download-attachments" }
@@ -194,17 +302,35 @@ func (cmd *donwloadAttachmentsCommand) Usage() string {
 }
 
 func (cmd *donwloadAttachmentsCommand) SetFlags(f *flag.FlagSet) {
-	f.StringVar(&cmd.path, "path", "", "Path to the Hangouts JSON file.")
+	f.StringVar(&cmd.path, "path", "", "Path to the Hangouts JSON file or Google Chat export directory.")
 	f.StringVar(&cmd.out, "out", "", "Path to the attachments output JSON file.")
-	f.StringVar(&cmd.conversationID, "conversation", "", "Conversation ID to dump.")
+	cmd.sel.SetFlags(f)
 	f.StringVar(&cmd.attachmentPath, "attachment_path", "", "If provided, download images here.")
-	f.StringVar(&cmd.cookiePath, "cookie_path", "", "Path to the cookie JSON file to use.")
+	f.StringVar(&cmd.dbPath, "db", "",
+		"If provided, persist attachment state in this database. Entries in -out are migrated into it.")
+	f.StringVar(&cmd.cookiePath, "cookie_path", "", "Path to the cookie file to use.")
+	f.StringVar(&cmd.cookieFormat, "cookie_format", string(parse.CookieFormatAuto),
+		"Format of the cookie file: auto, header (a Cookie header value), netscape (cookies.txt), or json.")
+	f.BoolVar(&cmd.reloadCookies, "reload_cookies", false,
+		"If the Google session expires, pause and wait for -cookie_path to be updated, rather than aborting.")
 	f.BoolVar(&cmd.overwrite, "overwrite", false, "Ignore existing download state.")
-}
-
-func (cmd *donwloadAttachmentsCommand) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
-	if cmd.conversationID == "" {
-		log.Printf("ERROR: you must supply a conversation ID (-conversation).")
+	f.BoolVar(&cmd.retryFailed, "retry_failed", false, "Only retry attachments that failed to download previously.")
+	f.IntVar(&cmd.maxAttempts, "max_attempts", 5,
+		"Skip attachments that have failed to download this many times. If <= 0, there is no limit.")
+	f.IntVar(&cmd.concurrency, "concurrency", 5, "Maximum number of concurrent downloads.")
+	f.Float64Var(&cmd.hostRate, "host_rate", 2, "Maximum requests per second to each host. If <= 0, there is no limit.")
+	f.IntVar(&cmd.hostBurst, "host_burst", 5, "Number of requests to each host that may be made at once before -host_rate applies.")
+	f.BoolVar(&cmd.adaptiveConcurrency, "adaptive_concurrency", true,
+		"Reduce concurrency when servers throttle requests (HTTP 429/503), and restore it as requests succeed.")
+	f.DurationVar(&cmd.progressInterval, "progress_interval", 10*time.Second,
+		"How often to report download progress. If <= 0, progress is not reported.")
+	f.StringVar(&cmd.statusPath, "status_path", "",
+		"If provided, write download progress to this JSON file each -progress_interval.")
+}
+
+func (cmd *donwloadAttachmentsCommand) Execute(ctx context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if err := cmd.sel.validate(); err != nil {
+		log.Printf("ERROR: %s", err)
 		return subcommands.ExitFailure
 	}
 
@@ -214,20 +340,30 @@ func (cmd *donwloadAttachmentsCommand) Execute(_ context.Context, f *flag.FlagSe
 		Overwrite: cmd.overwrite,
 	}
 	imageDownload := &parse.ImageDownloader{
-		AttachmentMapper: &am,
-		Concurrency:      5,
+		AttachmentMapper:    &am,
+		Concurrency:         cmd.concurrency,
+		RetryFailed:         cmd.retryFailed,
+		MaxAttempts:         cmd.maxAttempts,
+		HostRate:            cmd.hostRate,
+		HostBurst:           cmd.hostBurst,
+		AdaptiveConcurrency: cmd.adaptiveConcurrency,
+	}
+	if parse.IsGoogleChatExport(cmd.path) {
+		// Google Chat attachments are files in the export.
+		imageDownload.LocalRoot = cmd.path
 	}
 
 	if cmd.cookiePath != "" {
-		err := withBufferedReader(cmd.cookiePath, func(r io.Reader) (err error) {
-			imageDownload.Cookies, err = parse.LoadCookieJarFromText(r)
-			return
-		})
-		if err != nil {
+		var err error
+		if imageDownload.Cookies, err = cmd.loadCookies(); err != nil {
 			log.Printf("Could not load cookie jar from %s: %s", cmd.cookiePath, err)
 			return subcommands.ExitFailure
 		}
 		log.Printf("Loaded %d cookie(s)", len(imageDownload.Cookies))
+
+		if cmd.reloadCookies {
+			imageDownload.ReloadCookies = cmd.waitForNewCookies
+		}
 	}
 
 	if !cmd.overwrite {
@@ -245,16 +381,22 @@ func (cmd *donwloadAttachmentsCommand) Execute(_ context.Context, f *flag.FlagSe
 		}
 	}
 
-	r, err := loadRoot(cmd.path)
-	if err != nil {
-		log.Printf("ERROR: Failed to load root file: %s", err)
-		return subcommands.ExitFailure
-	}
-
-	c, err := r.GetConversation(cmd.conversationID)
-	if err != nil {
-		log.Printf("Could not get conversation %q: %s", cmd.conversationID, err)
-		return subcommands.ExitFailure
+	if cmd.dbPath != "" {
+		if cmd.overwrite {
+			if err := os.Remove(cmd.dbPath); err != nil && !os.IsNotExist(err) {
+				log.Printf("ERROR: Could not remove database %s: %s", cmd.dbPath, err)
+				return subcommands.ExitFailure
+			}
+		}
+		if err := am.OpenDB(cmd.dbPath); err != nil {
+			log.Printf("ERROR: Could not open attachment database: %s", err)
+			return subcommands.ExitFailure
+		}
+		defer func() {
+			if err := am.Close(); err != nil {
+				log.Printf("ERROR: Could not close attachment database: %s", err)
+			}
+		}()
 	}
 
 	if err := os.MkdirAll(cmd.attachmentPath, 0755); err != nil {
@@ -263,46 +405,112 @@ func (cmd *donwloadAttachmentsCommand) Execute(_ context.Context, f *flag.FlagSe
 	}
 
 	flushAttachments := func() error {
+		if cmd.out == "" {
+			return nil
+		}
 		return withBufferedWriter(cmd.out, func(w io.Writer) error {
 			return am.SaveToJSON(w)
 		})
 	}
 
-	const flushInterval = 100
-	added := 0
-	nextFlush := flushInterval
-
-	for i := 0; i < c.EventsSize(); i++ {
-		e, err := c.Event(i)
-		if err != nil {
-			log.Printf("Event #%d could not be processed: %s", i, err)
-			continue
+	if cmd.progressInterval > 0 {
+		pr := parse.ProgressReporter{
+			Downloader: imageDownload,
+			Interval:   cmd.progressInterval,
+			Out:        os.Stderr,
+			StatusPath: cmd.statusPath,
 		}
-
-		if cm := e.ChatMessage; cm != nil {
-			if mc := cm.MessageContent; mc != nil {
-				for _, a := range mc.Attachment {
-					if ei := a.EmbedItem; ei != nil {
-						if imageDownload.Add(ei) {
-							added++
-						}
+		progressCtx, cancelProgress := context.WithCancel(context.Background())
+		progressDone := make(chan struct{})
+		go func() {
+			defer close(progressDone)
+			pr.Run(progressCtx)
+		}()
+		defer func() {
+			cancelProgress()
+			<-progressDone
+		}()
+	}
+
+	// Add queues downloads without waiting for them, so flush periodically
+	// while they run. The database commits each entry; only flush JSON without
+	// one. Periodic flushes stop before the final flush.
+	stopFlushing := func() {}
+	if cmd.dbPath == "" && cmd.out != "" {
+		const flushInterval = 30 * time.Second
+		flushCtx, cancelFlush := context.WithCancel(context.Background())
+		flushDone := make(chan struct{})
+		go func() {
+			defer close(flushDone)
+			t := time.NewTicker(flushInterval)
+			defer t.Stop()
+			for {
+				select {
+				case <-t.C:
+					if err := flushAttachments(); err != nil {
+						log.Printf("WARNING: Failed to flush attachments: %s", err)
 					}
+				case <-flushCtx.Done():
+					return
 				}
 			}
+		}()
+		stopFlushing = func() {
+			cancelFlush()
+			<-flushDone
 		}
+	}
+	defer stopFlushing()
 
-		if added > nextFlush {
-			if err := flushAttachments(); err != nil {
-				log.Printf("ERROR: Failed to flush attachments: %s", err)
-				return subcommands.ExitFailure
+	err := forEachSelected(cmd.path, &cmd.sel, func(c parse.EventSource) error {
+		return c.ForEachEvent(func(i int, e *parse.Event) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := imageDownload.Err(); err != nil {
+				return err
 			}
-			nextFlush = added + flushInterval
+
+			if cm := e.ChatMessage; cm != nil {
+				if mc := cm.MessageContent; mc != nil {
+					for _, a := range mc.Attachment {
+						if ei := a.EmbedItem; ei != nil {
+							imageDownload.Add(ctx, e, ei)
+						}
+					}
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil && ctx.Err() == nil && imageDownload.Err() == nil {
+		log.Printf("ERROR: Could not process conversations: %s", err)
+		return subcommands.ExitFailure
+	}
+
+	log.Println("Waiting for images to download...")
+	err = imageDownload.Wait(ctx)
+	stopFlushing()
+	if err != nil {
+		// Save what we have, so that the next run can pick up where we left off.
+		if errors.Is(err, parse.SessionExpired) {
+			log.Printf("ERROR: %s. Saving progress.", err)
+		} else {
+			log.Printf("Interrupted; saving progress.")
+		}
+		if err := flushAttachments(); err != nil {
+			log.Printf("ERROR: Could not write output to %s: %s", cmd.out, err)
 		}
+		return subcommands.ExitFailure
 	}
 
-	if imageDownload != nil {
-		log.Println("Waiting for images to download...")
-		imageDownload.Wait()
+	failed := 0
+	am.RangeFailures(func(key string, f *attachment.Failure) bool {
+		failed++
+		return true
+	})
+	if failed > 0 {
+		log.Printf("%d attachment(s) could not be downloaded; use -retry_failed to retry them.", failed)
 	}
 	log.Println("Finished!")
 
@@ -314,11 +522,56 @@ func (cmd *donwloadAttachmentsCommand) Execute(_ context.Context, f *flag.FlagSe
 	return subcommands.ExitSuccess
 }
 
+func (cmd *donwloadAttachmentsCommand) loadCookies() (cookies []*http.Cookie, err error) {
+	err = withBufferedReader(cmd.cookiePath, func(r io.Reader) (err error) {
+		cookies, err = parse.LoadCookies(r, parse.CookieFormat(cmd.cookieFormat))
+		return
+	})
+	return
+}
+
+// waitForNewCookies waits for the cookie file to be modified, then loads it.
+func (cmd *donwloadAttachmentsCommand) waitForNewCookies(ctx context.Context) ([]*http.Cookie, error) {
+	const pollInterval = 5 * time.Second
+
+	st, err := os.Stat(cmd.cookiePath)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Waiting for fresh cookies to be exported to %s...", cmd.cookiePath)
+
+	for {
+		select {
+		case <-time.After(pollInterval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		cur, err := os.Stat(cmd.cookiePath)
+		switch {
+		case os.IsNotExist(err):
+			// The file may be in the middle of being replaced.
+			continue
+		case err != nil:
+			return nil, err
+		case cur.ModTime().Equal(st.ModTime()) && cur.Size() == st.Size():
+			continue
+		}
+
+		cookies, err := cmd.loadCookies()
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Loaded %d cookie(s)", len(cookies))
+		return cookies, nil
+	}
+}
+
 type generateUserList struct {
 	path string
 	out  string
 
-	conversationID string
+	sel conversationSelector
 }
 
 func (cmd *generateUserList) Name() string { return "generate-user-list" }
@@ -332,26 +585,34 @@ func (cmd *generateUserList) Usage() string {
 }
 
 func (cmd *generateUserList) SetFlags(f *flag.FlagSet) {
-	f.StringVar(&cmd.path, "path", "", "Path to the Hangouts JSON file.")
+	f.StringVar(&cmd.path, "path", "", "Path to the Hangouts JSON file or Google Chat export directory.")
 	f.StringVar(&cmd.out, "out", "", "Destination output path.")
-	f.StringVar(&cmd.conversationID, "conversation", "", "Conversation ID to dump.")
+	cmd.sel.SetFlags(f)
 }
 
 func (cmd *generateUserList) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
-	r, err := loadRoot(cmd.path)
-	if err != nil {
-		log.Printf("ERROR: Failed to load root file: %s", err)
+	if err := cmd.sel.validate(); err != nil {
+		log.Printf("ERROR: %s", err)
 		return subcommands.ExitFailure
 	}
 
-	c, err := r.GetConversation(cmd.conversationID)
+	// Merge the participants of all selected conversations.
+	var reg parse.ParticipantRegistry
+	err := forEachSelected(cmd.path, &cmd.sel, func(c parse.EventSource) error {
+		for _, pd := range c.ParticipantRegistry().AllParticipants() {
+			if reg.ForID(&pd.ID) == nil {
+				reg.Register(pd)
+			}
+		}
+		return nil
+	})
 	if err != nil {
-		log.Printf("Could not get conversation %q: %s", cmd.conversationID, err)
+		log.Printf("Could not load participants: %s", err)
 		return subcommands.ExitFailure
 	}
 
 	err = withBufferedWriter(cmd.out, func(w io.Writer) error {
-		return mattermost.SerializeParticipantsToJSON(c.ParticipantRegistry(), w)
+		return mattermost.SerializeParticipantsToJSON(&reg, w)
 	})
 	if err != nil {
 		log.Printf("Could not serialize users: %s", err)
@@ -363,9 +624,11 @@ func (cmd *generateUserList) Execute(_ context.Context, f *flag.FlagSet, _ ...in
 type generateBulkImport struct {
 	path string
 	out  string
+	zip  bool
 
-	conversationID       string
+	sel                  conversationSelector
 	attachmentMapJSON    string
+	attachmentMapDB      string
 	remoteAttachmentPath string
 	userMapPath          string
 
@@ -373,6 +636,17 @@ type generateBulkImport struct {
 	mmTeamDisplayName    string
 	mmChannelName        string
 	mmChannelDisplayName string
+	mmDirectChannels     bool
+
+	mmSystemPosts             bool
+	mmSystemPostUser          string
+	mmChannelNamesFromRenames bool
+	mmCallPosts               bool
+	mmThreadGap               time.Duration
+	mmMaxMessageLength        int
+	mmLongMessages            string
+	mmOverflowPath            string
+	mmAttachmentReplies       bool
 }
 
 func (cmd *generateBulkImport) Name() string     { return "generate-bulk-import" }
@@ -384,45 +658,72 @@ func (cmd *generateBulkImport) Usage() string {
 }
 
 func (cmd *generateBulkImport) SetFlags(f *flag.FlagSet) {
-	f.StringVar(&cmd.path, "path", "", "Path to the Hangouts JSON file.")
+	f.StringVar(&cmd.path, "path", "", "Path to the Hangouts JSON file or Google Chat export directory.")
 	f.StringVar(&cmd.out, "out", "", "Destination output path.")
-	f.StringVar(&cmd.conversationID, "conversation", "", "Conversation ID to dump.")
+	f.BoolVar(&cmd.zip, "zip", false,
+		"Write a MatterMost import archive (for \"mmctl import upload\"), containing the JSONL and the attachments it references. "+
+			"-remote_attachment_path is then a path within the archive's data directory.")
+	cmd.sel.SetFlags(f)
 	f.StringVar(&cmd.attachmentMapJSON, "attachment_map_json", "", "The JSON mapping for attachment keys to files.")
-	f.StringVar(&cmd.remoteAttachmentPath, "remote_attachment_path", "", "If provided, download images here.")
+	f.StringVar(&cmd.attachmentMapDB, "attachment_map_db", "", "The database mapping attachment keys to files.")
+	f.StringVar(&cmd.remoteAttachmentPath, "remote_attachment_path", "",
+		"The directory that attachment paths in the import refer to: on the MatterMost server or, with -zip, within the archive's data directory.")
 	f.StringVar(&cmd.userMapPath, "user_map_path", "", "The Hangout username to MatterMost ID map JSON.")
 
 	f.StringVar(&cmd.mmTeamName, "mm_team_name", "", "The destination MatterMots team name.")
 	f.StringVar(&cmd.mmTeamDisplayName, "mm_team_display_name", "", "The destination MatterMost team display name.")
 	f.StringVar(&cmd.mmChannelName, "mm_channel_name", "", "The destination MatterMost channel name.")
 	f.StringVar(&cmd.mmChannelDisplayName, "mm_channel_display_name", "", "The destination MatterMost channel display name.")
+	f.BoolVar(&cmd.mmDirectChannels, "mm_direct_channels", false,
+		"Import one-to-one and small group chats as MatterMost direct/group messages instead of private channels.")
+	f.BoolVar(&cmd.mmSystemPosts, "mm_system_posts", false,
+		"Import conversation renames and membership changes as posts describing them.")
+	f.StringVar(&cmd.mmSystemPostUser, "mm_system_post_user", "",
+		"The username (from the user map) that authors system posts. By default, the user who made the change does.")
+	f.BoolVar(&cmd.mmChannelNamesFromRenames, "mm_channel_names_from_renames", false,
+		"Set each channel's display name from the conversation's final rename, and its header from the previous name.")
+	f.BoolVar(&cmd.mmCallPosts, "mm_call_posts", false,
+		"Import the end of each voice or video call as a post describing its length and participants.")
+	f.DurationVar(&cmd.mmThreadGap, "mm_thread_gap", 0,
+		"If set, group posts separated by less than this idle time (e.g., 30m) into threads of replies.")
+	f.IntVar(&cmd.mmMaxMessageLength, "mm_max_message_length", mattermost.DefaultMaxMessageLength,
+		"The maximum length of a MatterMost post, in characters.")
+	f.StringVar(&cmd.mmLongMessages, "mm_long_messages", string(mattermost.LongMessageSplit),
+		"How to import longer messages: \"split\" into several posts, or \"attach\" their full text as a file.")
+	f.StringVar(&cmd.mmOverflowPath, "mm_overflow_path", "",
+		"With -mm_long_messages=attach, write the full text of long messages here. Copy these files alongside the other attachments.")
+	f.BoolVar(&cmd.mmAttachmentReplies, "mm_attachment_replies", false,
+		"Import attachments that don't fit in a post as replies to it, rather than as the posts that follow it.")
 }
 
 func (cmd *generateBulkImport) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
-	userMapper, reactionInjector, err := loadUserMapJSON(cmd.userMapPath)
-	if err != nil {
-		log.Printf("ERROR: Failed to load usermap from %s: %s", cmd.userMapPath, err)
+	if err := cmd.sel.validate(); err != nil {
+		log.Printf("ERROR: %s", err)
 		return subcommands.ExitFailure
 	}
 
-	r, err := loadRoot(cmd.path)
-	if err != nil {
-		log.Printf("ERROR: Failed to load root file: %s", err)
-		return subcommands.ExitFailure
-	}
-
-	c, err := r.GetConversation(cmd.conversationID)
+	userMapper, reactionInjector, err := loadUserMapJSON(cmd.userMapPath)
 	if err != nil {
-		log.Printf("Could not get conversation %q: %s", cmd.conversationID, err)
+		log.Printf("ERROR: Failed to load usermap from %s: %s", cmd.userMapPath, err)
 		return subcommands.ExitFailure
 	}
 
 	am := attachment.Mapper{}
-	err = withBufferedReader(cmd.attachmentMapJSON, func(r io.Reader) error {
-		return am.LoadFromJSON(r)
-	})
-	if err != nil {
-		log.Printf("Could not load attachment map from %q: %s", cmd.attachmentMapJSON, err)
-		return subcommands.ExitFailure
+	if cmd.attachmentMapJSON != "" || cmd.attachmentMapDB == "" {
+		err = withBufferedReader(cmd.attachmentMapJSON, func(r io.Reader) error {
+			return am.LoadFromJSON(r)
+		})
+		if err != nil {
+			log.Printf("Could not load attachment map from %q: %s", cmd.attachmentMapJSON, err)
+			return subcommands.ExitFailure
+		}
+	}
+	if cmd.attachmentMapDB != "" {
+		if err := am.OpenDB(cmd.attachmentMapDB); err != nil {
+			log.Printf("Could not load attachment map: %s", err)
+			return subcommands.ExitFailure
+		}
+		defer am.Close()
 	}
 
 	big := mattermost.BulkImportGenerator{
@@ -434,17 +735,53 @@ func (cmd *generateBulkImport) Execute(_ context.Context, f *flag.FlagSet, _ ...
 		AttachmentMapper:   &am,
 		ReactionInjector:   reactionInjector,
 		DestAttachmentDir:  cmd.remoteAttachmentPath,
+		DirectChannels:     cmd.mmDirectChannels,
+
+		SystemPosts:             cmd.mmSystemPosts,
+		SystemPostUser:          cmd.mmSystemPostUser,
+		ChannelNamesFromRenames: cmd.mmChannelNamesFromRenames,
+		CallPosts:               cmd.mmCallPosts,
+		ThreadGap:               cmd.mmThreadGap,
+		MaxMessageLength:        cmd.mmMaxMessageLength,
+		LongMessages:            mattermost.LongMessageMode(cmd.mmLongMessages),
+		OverflowDir:             cmd.mmOverflowPath,
+		AttachmentReplies:       cmd.mmAttachmentReplies,
 	}
 
-	err = withBufferedWriter(cmd.out, func(w io.Writer) error {
-		biw := mattermost.NewWriter(w)
-		if err := big.Build(c, biw); err != nil {
-			return err
+	// Import every selected conversation into its own channel (or, with a single
+	// conversation, the named channel). The conversations are streamed several
+	// times, once per import pass.
+	forEach := func(fn func(c parse.EventSource) error) error {
+		return forEachSelected(cmd.path, &cmd.sel, fn)
+	}
+
+	if !cmd.zip {
+		err = withBufferedWriter(cmd.out, func(w io.Writer) error {
+			return big.BuildAll(forEach, mattermost.NewWriter(w))
+		})
+		if err != nil {
+			log.Printf("Failed to serialize bulk import to JSONL: %s", err)
+			return subcommands.ExitFailure
 		}
-		return nil
+		return subcommands.ExitSuccess
+	}
+
+	// The archive includes the full text of long messages, so they needn't be
+	// kept anywhere else.
+	if big.LongMessages == mattermost.LongMessageAttach && big.OverflowDir == "" {
+		dir, err := ioutil.TempDir("", "hangouts-migrate-overflow")
+		if err != nil {
+			log.Printf("ERROR: Could not create overflow directory: %s", err)
+			return subcommands.ExitFailure
+		}
+		defer os.RemoveAll(dir)
+		big.OverflowDir = dir
+	}
+	err = withBufferedWriter(cmd.out, func(w io.Writer) error {
+		return big.BuildArchive(forEach, w)
 	})
 	if err != nil {
-		log.Printf("Failed to serialize bulk import to JSONL: %s", err)
+		log.Printf("Failed to write import archive: %s", err)
 		return subcommands.ExitFailure
 	}
 	return subcommands.ExitSuccess
@@ -454,7 +791,7 @@ type printAllText struct {
 	path string
 	out  string
 
-	conversationID     string
+	sel                conversationSelector
 	chatID             string
 	excludeRegexpsPath string
 }
@@ -468,9 +805,9 @@ func (cmd *printAllText) Usage() string {
 }
 
 func (cmd *printAllText) SetFlags(f *flag.FlagSet) {
-	f.StringVar(&cmd.path, "path", "", "Path to the Hangouts JSON file.")
+	f.StringVar(&cmd.path, "path", "", "Path to the Hangouts JSON file or Google Chat export directory.")
 	f.StringVar(&cmd.out, "out", "", "Destination output path.")
-	f.StringVar(&cmd.conversationID, "conversation", "", "Conversation ID to dump.")
+	cmd.sel.SetFlags(f)
 	f.StringVar(&cmd.chatID, "chat_id", "", "Isolate to just this chat ID.")
 	f.StringVar(&cmd.excludeRegexpsPath, "exclude_regexps", "", "Path of an exclude regexp list.")
 }
@@ -478,53 +815,46 @@ func (cmd *printAllText) SetFlags(f *flag.FlagSet) {
 var alphaNumeric = regexp.MustCompile("[^A-Za-z0-9]+")
 
 func (cmd *printAllText) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
-	excludeRegexp, err := cmd.buildExcludeRegexp()
-	if err != nil {
-		log.Printf("Could not compile exclude regexps: %s", err)
+	if err := cmd.sel.validate(); err != nil {
+		log.Printf("ERROR: %s", err)
 		return subcommands.ExitFailure
 	}
 
-	r, err := loadRoot(cmd.path)
-	if err != nil {
-		log.Printf("ERROR: Failed to load root file: %s", err)
-		return subcommands.ExitFailure
-	}
-
-	c, err := r.GetConversation(cmd.conversationID)
+	excludeRegexp, err := cmd.buildExcludeRegexp()
 	if err != nil {
-		log.Printf("Could not get conversation %q: %s", cmd.conversationID, err)
+		log.Printf("Could not compile exclude regexps: %s", err)
 		return subcommands.ExitFailure
 	}
 
 	err = withBufferedWriter(cmd.out, func(w io.Writer) error {
 		var excluded int64
-		for i := 0; i < c.EventsSize(); i++ {
-			e, err := c.Event(i)
-			if err != nil {
-				log.Printf("Failed to get event #%d: %s", i, err)
-				continue
-			}
-
-			if cmd.chatID != "" && e.SenderID.ChatID != cmd.chatID {
-				continue
-			}
-
-			for _, word := range e.AllWords() {
-				if excludeRegexp != nil && excludeRegexp.MatchString(word) {
-					excluded++
-					continue
+		err := forEachSelected(cmd.path, &cmd.sel, func(c parse.EventSource) error {
+			return c.ForEachEvent(func(i int, e *parse.Event) error {
+				if cmd.chatID != "" && e.SenderID.ChatID != cmd.chatID {
+					return nil
 				}
 
-				// Remove non-alphanumeric characters.
-				word = alphaNumeric.ReplaceAllString(word, "")
+				for _, word := range e.AllWords() {
+					if excludeRegexp != nil && excludeRegexp.MatchString(word) {
+						excluded++
+						continue
+					}
+
+					// Remove non-alphanumeric characters.
+					word = alphaNumeric.ReplaceAllString(word, "")
 
-				if _, err := w.Write([]byte(word)); err != nil {
-					return err
-				}
-				if _, err := w.Write([]byte("\n")); err != nil {
-					return err
+					if _, err := w.Write([]byte(word)); err != nil {
+						return err
+					}
+					if _, err := w.Write([]byte("\n")); err != nil {
+						return err
+					}
 				}
-			}
+				return nil
+			})
+		})
+		if err != nil {
+			return err
 		}
 		log.Printf("Excluded %d word(s)", excluded)
 		return nil
@@ -587,11 +917,28 @@ func Main(argv []string) int {
 	subcommands.Register(&listChatsCommand{}, "")
 	subcommands.Register(&dumpChatCommand{}, "")
 	subcommands.Register(&donwloadAttachmentsCommand{}, "")
+	subcommands.Register(&verifyAttachmentsCommand{}, "")
 	subcommands.Register(&generateUserList{}, "")
 	subcommands.Register(&generateBulkImport{}, "")
 	subcommands.Register(&printAllText{}, "")
 
 	flag.Parse()
-	ctx := context.Background()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cancelOnSignal(cancel)
 	return int(subcommands.Execute(ctx))
 }
+
+// cancelOnSignal calls cancel when the process receives SIGINT or SIGTERM,
+// allowing commands to shut down cleanly. A second signal terminates the
+// process immediately.
+func cancelOnSignal(cancel context.CancelFunc) {
+	signalC := make(chan os.Signal, 1)
+	signal.Notify(signalC, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signalC
+		log.Printf("Received %s; shutting down. Signal again to exit immediately.", sig)
+		signal.Stop(signalC)
+		cancel()
+	}()
+}
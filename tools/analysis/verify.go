@@ -0,0 +1,118 @@
+package analysis
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+
+	"github.com/danjacques/hangouts-migrate/attachment"
+	"github.com/google/subcommands"
+)
+
+type verifyAttachmentsCommand struct {
+	manifest       string
+	dbPath         string
+	attachmentPath string
+
+	checkHash bool
+	fix       bool
+}
+
+func (cmd *verifyAttachmentsCommand) Name() string { return "verify-attachments" }
+func (cmd *verifyAttachmentsCommand) Synopsis() string {
+	return "Checks the integrity of downloaded attachments."
+}
+func (cmd *verifyAttachmentsCommand) Usage() string {
+	return `verify-attachments [-manifest /path/to/attachments.json | -db /path/to/attachments.db] -attachment_path DIR
+	Report missing, empty, truncated, mistyped, orphaned, and temporary attachment files, and resumable downloads.
+	`
+}
+
+func (cmd *verifyAttachmentsCommand) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&cmd.manifest, "manifest", "", "Path to the attachments JSON file.")
+	f.StringVar(&cmd.dbPath, "db", "", "Path to the attachments database.")
+	f.StringVar(&cmd.attachmentPath, "attachment_path", "", "Path to the attachment directory.")
+	f.BoolVar(&cmd.checkHash, "check_hash", false, "Verify the SHA-256 of each attachment. This reads every file in full.")
+	f.BoolVar(&cmd.fix, "fix", false,
+		"Delete orphaned and temporary files, and drop bad entries (and their files) so they are downloaded again.")
+}
+
+func (cmd *verifyAttachmentsCommand) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if cmd.manifest == "" && cmd.dbPath == "" {
+		log.Printf("ERROR: you must supply a manifest (-manifest) or database (-db).")
+		return subcommands.ExitFailure
+	}
+
+	am := attachment.Mapper{
+		BasePath:    cmd.attachmentPath,
+		KeepMissing: true,
+	}
+	if cmd.manifest != "" {
+		err := withBufferedReader(cmd.manifest, func(r io.Reader) error {
+			return am.LoadFromJSON(r)
+		})
+		if err != nil {
+			log.Printf("ERROR: Could not load manifest from %s: %s", cmd.manifest, err)
+			return subcommands.ExitFailure
+		}
+	}
+	if cmd.dbPath != "" {
+		if err := am.OpenDB(cmd.dbPath); err != nil {
+			log.Printf("ERROR: Could not open attachment database: %s", err)
+			return subcommands.ExitFailure
+		}
+		defer am.Close()
+	}
+
+	problems, err := am.Verify(&attachment.VerifyOptions{
+		CheckHash: cmd.checkHash,
+		Ignore:    []string{cmd.manifest, cmd.dbPath},
+	})
+	if err != nil {
+		log.Printf("ERROR: Could not verify attachments: %s", err)
+		return subcommands.ExitFailure
+	}
+
+	counts := make(map[attachment.ProblemKind]int)
+	var kinds []string
+	for _, p := range problems {
+		fmt.Println(p)
+		if counts[p.Kind] == 0 {
+			kinds = append(kinds, string(p.Kind))
+		}
+		counts[p.Kind]++
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		log.Printf("Found %d %s problem(s).", counts[attachment.ProblemKind(kind)], kind)
+	}
+	// Resumable downloads are not problems to fix.
+	fixable := len(problems) - counts[attachment.ProblemResumable]
+	if fixable == 0 {
+		log.Println("No problems found!")
+		return subcommands.ExitSuccess
+	}
+
+	if !cmd.fix {
+		return subcommands.ExitFailure
+	}
+
+	if err := am.Fix(problems); err != nil {
+		log.Printf("ERROR: Could not fix problems: %s", err)
+		return subcommands.ExitFailure
+	}
+	if cmd.manifest != "" {
+		err := withBufferedWriter(cmd.manifest, func(w io.Writer) error {
+			return am.SaveToJSON(w)
+		})
+		if err != nil {
+			log.Printf("ERROR: Could not write manifest to %s: %s", cmd.manifest, err)
+			return subcommands.ExitFailure
+		}
+	}
+	log.Printf("Fixed %d problem(s).", fixable)
+	return subcommands.ExitSuccess
+}